@@ -0,0 +1,351 @@
+package smtpsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCStatus is the ARC chain validation status (cv), as in RFC 8617.
+type ARCStatus string
+
+const (
+	ARCNone ARCStatus = "none"
+	ARCPass ARCStatus = "pass"
+	ARCFail ARCStatus = "fail"
+)
+
+// maxARCInstances is the highest instance number of an ARC set.
+const maxARCInstances = 50
+
+// ARCResult is the validation of the ARC chain of a message.
+type ARCResult struct {
+	Status ARCStatus
+
+	// Instances is the number of ARC sets, Domain the signing domain of the latest ARC-Seal.
+	Instances int
+	Domain    string
+
+	// Err is the reason of a fail status.
+	Err error
+}
+
+// DefaultARCHeaders are the header fields signed by the ARC-Message-Signature of an ARCSealer.
+var DefaultARCHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+// arcSet is the raw ARC-Authentication-Results, ARC-Message-Signature and ARC-Seal fields of an instance.
+type arcSet struct {
+	results   string
+	signature string
+	seal      string
+}
+
+// VerifyARC validates the ARC chain of the message as in RFC 8617 section 5.2, fetching the keys through resolver.
+// The error is only about reading the message, the validation errors are part of the result.
+func VerifyARC(ctx context.Context, r io.ReadSeeker, resolver Resolver) (*ARCResult, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	fields, _, err := readRawHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ARCResult{Status: ARCNone}
+
+	sets, err := collectARCSets(fields)
+	if err != nil {
+		result.Status, result.Err = ARCFail, err
+		return result, nil
+	} else if len(sets) == 0 {
+		return result, nil
+	}
+
+	result.Instances = len(sets)
+
+	fail := func(err error) (*ARCResult, error) {
+		result.Status, result.Err = ARCFail, err
+		return result, nil
+	}
+
+	seals := make([]map[string]string, len(sets))
+	for i, set := range sets {
+		if seals[i], err = parseTagList(fieldValue(set.seal)); err != nil {
+			return fail(fmt.Errorf("arc: malformed seal %d", i+1))
+		}
+
+		// the first set starts the chain, the next ones must have found it valid
+		cv, expected := ARCStatus(seals[i]["cv"]), ARCPass
+		if i == 0 {
+			expected = ARCNone
+		}
+
+		if cv != expected {
+			return fail(fmt.Errorf("arc: seal %d has cv=%s", i+1, cv))
+		}
+	}
+
+	result.Domain = strings.ToLower(seals[len(seals)-1]["d"])
+
+	// only the latest message signature matters, the older ones were broken by the forwarders on purpose
+	latest := sets[len(sets)-1]
+	signature, err := parseTagList(fieldValue(latest.signature))
+	if err != nil {
+		return fail(errors.New("arc: malformed message signature"))
+	}
+
+	if status, err := verifyMessageSignature(ctx, r, fields, latest.signature, signature, resolver); status != DKIMPass {
+		return fail(fmt.Errorf("arc: message signature %d: %v", len(sets), err))
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if _, ok := seals[i]["h"]; ok {
+			return fail(fmt.Errorf("arc: seal %d has a h= tag", i+1))
+		}
+
+		key, _, err := lookupDKIMKey(ctx, resolver, seals[i]["s"], strings.ToLower(seals[i]["d"]))
+		if err != nil {
+			return fail(fmt.Errorf("arc: seal %d: %v", i+1, err))
+		}
+
+		if err := key.verify(seals[i]["a"], computeSealHash(sets, i), seals[i]["b"]); err != nil {
+			return fail(fmt.Errorf("arc: seal %d: %v", i+1, err))
+		}
+	}
+
+	result.Status = ARCPass
+
+	return result, nil
+}
+
+// collectARCSets groups the ARC header fields by instance, checking that the instances are complete and contiguous.
+func collectARCSets(fields []string) ([]arcSet, error) {
+	byInstance := map[int]*arcSet{}
+	for _, field := range fields {
+		var slot func(set *arcSet) *string
+		switch strings.ToLower(fieldName(field)) {
+		case "arc-authentication-results":
+			slot = func(set *arcSet) *string { return &set.results }
+		case "arc-message-signature":
+			slot = func(set *arcSet) *string { return &set.signature }
+		case "arc-seal":
+			slot = func(set *arcSet) *string { return &set.seal }
+		default:
+			continue
+		}
+
+		instance, err := arcInstance(field)
+		if err != nil {
+			return nil, err
+		}
+
+		set, ok := byInstance[instance]
+		if !ok {
+			set = &arcSet{}
+			byInstance[instance] = set
+		}
+
+		if *slot(set) != "" {
+			return nil, fmt.Errorf("arc: duplicate %s for instance %d", fieldName(field), instance)
+		}
+
+		*slot(set) = field
+	}
+
+	sets := make([]arcSet, len(byInstance))
+	for instance, set := range byInstance {
+		if instance > len(sets) {
+			return nil, fmt.Errorf("arc: instance %d is out of sequence", instance)
+		}
+
+		if set.results == "" || set.signature == "" || set.seal == "" {
+			return nil, fmt.Errorf("arc: incomplete set for instance %d", instance)
+		}
+
+		sets[instance-1] = *set
+	}
+
+	return sets, nil
+}
+
+// lastARCInstance returns the highest instance among the ARC header fields, the malformed ones left out.
+func lastARCInstance(fields []string) int {
+	last := 0
+	for _, field := range fields {
+		switch strings.ToLower(fieldName(field)) {
+		case "arc-authentication-results", "arc-message-signature", "arc-seal":
+		default:
+			continue
+		}
+
+		if instance, err := arcInstance(field); err == nil && instance > last {
+			last = instance
+		}
+	}
+
+	return last
+}
+
+// arcInstance returns the i= tag of an ARC header field, it must come first.
+func arcInstance(field string) (int, error) {
+	value := fieldValue(field)
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "i=") {
+		return 0, fmt.Errorf("arc: missing instance in %s", fieldName(field))
+	}
+
+	instance, err := strconv.Atoi(strings.TrimSpace(value[2:]))
+	if err != nil || instance < 1 || instance > maxARCInstances {
+		return 0, fmt.Errorf("arc: invalid instance in %s", fieldName(field))
+	}
+
+	return instance, nil
+}
+
+// computeSealHash returns the hash signed by the ARC-Seal of sets[i], covering the sets up to it, as in RFC 8617 section 5.1.1.
+func computeSealHash(sets []arcSet, i int) []byte {
+	h := sha256.New()
+	for j := 0; j <= i; j++ {
+		io.WriteString(h, canonicalizeHeader(sets[j].results, true))
+		io.WriteString(h, canonicalizeHeader(sets[j].signature, true))
+
+		if j < i {
+			io.WriteString(h, canonicalizeHeader(sets[j].seal, true))
+		} else {
+			io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(emptySignatureValue(sets[j].seal), true), "\r\n"))
+		}
+	}
+
+	return h.Sum(nil)
+}
+
+// ARC validates the ARC chain of the message once per transaction, see VerifyARC.
+func (c Context) ARC() (*ARCResult, error) {
+	tx := c.session.transaction()
+	if tx.arc == nil {
+		ctx, cancel := c.session.lookupContext()
+		defer cancel()
+
+		result, err := VerifyARC(ctx, c.Body(), c.session.resolver())
+		if err != nil {
+			return nil, err
+		}
+
+		tx.arc = result
+	}
+
+	return tx.arc, nil
+}
+
+// ARCSealer adds a new ARC set to the messages we forward, as in RFC 8617 section 5.1.
+type ARCSealer struct {
+	// Domain and Selector locate the public key of Key, an *rsa.PrivateKey or ed25519.PrivateKey.
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+
+	// AuthServID names us in the ARC-Authentication-Results, e.g. the BannerDomain.
+	AuthServID string
+
+	// Headers are signed by the ARC-Message-Signature, they default to DefaultARCHeaders.
+	Headers []string
+}
+
+// Seal returns the ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results header fields to prepend
+// to the message read from r. results are our authentication results without the authserv-id,
+// e.g. "spf=pass smtp.mailfrom=example.com", and chain is the validation of the existing ARC chain.
+func (s *ARCSealer) Seal(r io.ReadSeeker, results string, chain ARCStatus) (string, error) {
+	algorithm, _, err := keyAlgorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	fields, _, err := readRawHeader(r)
+	if err != nil {
+		return "", err
+	}
+
+	sets, broken := collectARCSets(fields)
+	instance := len(sets) + 1
+	if broken != nil {
+		// a broken chain is sealed as failed after its highest instance, the seal only covers our set
+		sets, chain = nil, ARCFail
+		instance = lastARCInstance(fields) + 1
+	}
+
+	if instance > maxARCInstances {
+		return "", errors.New("arc: too many instances")
+	}
+
+	cv := chain
+	if instance == 1 && broken == nil {
+		cv = ARCNone
+	}
+
+	if results == "" {
+		results = "none"
+	}
+
+	set := arcSet{
+		results: fmt.Sprintf("ARC-Authentication-Results: i=%d; %s; %s\r\n", instance, s.AuthServID, results),
+	}
+
+	headers := s.Headers
+	if headers == nil {
+		headers = DefaultARCHeaders
+	}
+
+	var names []string
+	for _, name := range headers {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+
+	bodyHash, err := computeBodyHash(r, true, -1)
+	if err != nil {
+		return "", err
+	}
+
+	timestamp := time.Now().Unix()
+
+	set.signature = fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=\r\n",
+		instance, algorithm, s.Domain, s.Selector, timestamp, strings.Join(names, ":"), encodeBase64(bodyHash))
+	sig, err := signHash(s.Key, computeHeaderHash(fields, names, set.signature, true))
+	if err != nil {
+		return "", err
+	}
+	set.signature = strings.TrimSuffix(set.signature, "\r\n") + sig + "\r\n"
+
+	set.seal = fmt.Sprintf("ARC-Seal: i=%d; a=%s; cv=%s; d=%s; s=%s; t=%d; b=\r\n",
+		instance, algorithm, cv, s.Domain, s.Selector, timestamp)
+	sets = append(sets, set)
+	sig, err = signHash(s.Key, computeSealHash(sets, len(sets)-1))
+	if err != nil {
+		return "", err
+	}
+	set.seal = strings.TrimSuffix(set.seal, "\r\n") + sig + "\r\n"
+
+	return set.seal + set.signature + set.results, nil
+}
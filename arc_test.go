@@ -0,0 +1,92 @@
+package smtpsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// publishKey adds the DKIM key record of key to records.
+func publishKey(t *testing.T, records *FakeResolver, selector, domain string, key crypto.Signer) {
+	t.Helper()
+
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		require.NoError(t, err)
+		records.TXT[selector+"._domainkey."+domain] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}
+	case ed25519.PublicKey:
+		records.TXT[selector+"._domainkey."+domain] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+	}
+}
+
+func TestARC(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	records := &FakeResolver{TXT: map[string][]string{}}
+	publishKey(t, records, "arc", "lists.example.org", rsaKey)
+	publishKey(t, records, "arc", "relay.example.net", edKey)
+
+	message := strings.Replace(testDKIMRSAMessage, "\n", "\r\n", -1)
+
+	result, err := VerifyARC(context.Background(), strings.NewReader(message), records)
+	require.NoError(t, err)
+	require.Equal(t, &ARCResult{Status: ARCNone}, result)
+
+	list := &ARCSealer{Domain: "lists.example.org", Selector: "arc", Key: rsaKey, AuthServID: "lists.example.org"}
+	sealed, err := list.Seal(strings.NewReader(message), "dkim=pass header.d=example.com", result.Status)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(sealed, "ARC-Seal: i=1; a=rsa-sha256; cv=none; d=lists.example.org;"))
+	message = sealed + message
+
+	result, err = VerifyARC(context.Background(), strings.NewReader(message), records)
+	require.NoError(t, err)
+	require.Equal(t, &ARCResult{Status: ARCPass, Instances: 1, Domain: "lists.example.org"}, result)
+
+	// the list footer breaks the first message signature, but not the chain
+	message = strings.Replace(message, "Joe.\r\n", "Joe.\r\n--\r\nList footer\r\n", 1)
+
+	relay := &ARCSealer{Domain: "relay.example.net", Selector: "arc", Key: edKey, AuthServID: "relay.example.net"}
+	sealed, err = relay.Seal(strings.NewReader(message), "arc=pass", ARCPass)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(sealed, "ARC-Seal: i=2; a=ed25519-sha256; cv=pass; d=relay.example.net;"))
+	message = sealed + message
+
+	result, err = VerifyARC(context.Background(), strings.NewReader(message), records)
+	require.NoError(t, err)
+	require.Equal(t, &ARCResult{Status: ARCPass, Instances: 2, Domain: "relay.example.net"}, result)
+
+	tampered := strings.Replace(message, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1)
+	result, err = VerifyARC(context.Background(), strings.NewReader(tampered), records)
+	require.NoError(t, err)
+	require.Equal(t, ARCFail, result.Status)
+	require.EqualError(t, result.Err, "arc: message signature 2: signature mismatch")
+
+	incomplete := strings.Replace(message, "ARC-Seal: i=1;", "X-Removed: i=1;", 1)
+	result, err = VerifyARC(context.Background(), strings.NewReader(incomplete), records)
+	require.NoError(t, err)
+	require.Equal(t, ARCFail, result.Status)
+	require.EqualError(t, result.Err, "arc: incomplete set for instance 1")
+
+	// a broken chain is sealed as failed, not restarted
+	sealed, err = list.Seal(strings.NewReader(incomplete), "arc=fail", ARCPass)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(sealed, "ARC-Seal: i=3; a=rsa-sha256; cv=fail; d=lists.example.org;"))
+	require.Contains(t, sealed, "ARC-Message-Signature: i=3;")
+	require.Contains(t, sealed, "ARC-Authentication-Results: i=3; lists.example.org; arc=fail\r\n")
+
+	result, err = VerifyARC(context.Background(), strings.NewReader(sealed+incomplete), records)
+	require.NoError(t, err)
+	require.Equal(t, ARCFail, result.Status)
+}
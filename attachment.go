@@ -0,0 +1,509 @@
+package smtpsrv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Attachment policy defaults.
+const (
+	// DefaultAttachmentDepth is the number of nested archives inspected when AttachmentPolicy.MaxDepth is zero.
+	DefaultAttachmentDepth = 3
+	// DefaultAttachmentExpansion bounds the decompressed size of an archive entry, against archive bombs.
+	DefaultAttachmentExpansion = 64 << 20
+)
+
+// DefaultDangerousExtensions are blocked when AttachmentPolicy.DangerousExtensions is nil.
+var DefaultDangerousExtensions = []string{
+	"ade", "adp", "app", "appx", "bat", "cab", "chm", "cmd", "com", "cpl", "dll", "exe", "gadget", "hta",
+	"inf", "ins", "isp", "iso", "jar", "jnlp", "js", "jse", "lnk", "mde", "msc", "msi", "msix", "msp", "mst",
+	"pif", "ps1", "reg", "scf", "scr", "sct", "shb", "sys", "vb", "vbe", "vbs", "vhd", "vxd", "wsc", "wsf", "wsh",
+}
+
+// documentExtensions are the extensions a double extension pretends to, e.g. invoice.pdf.exe.
+var documentExtensions = map[string]bool{
+	"pdf": true, "doc": true, "docx": true, "xls": true, "xlsx": true, "ppt": true, "pptx": true, "odt": true,
+	"rtf": true, "txt": true, "csv": true, "jpg": true, "jpeg": true, "png": true, "gif": true, "mp3": true,
+	"mp4": true, "htm": true, "html": true,
+}
+
+// executableTypes are the file types never accepted, whatever the name.
+var executableTypes = map[string]bool{"exe": true, "elf": true, "mach-o": true, "lnk": true}
+
+// AttachmentViolation is an attachment, or an archive entry, breaking the policy.
+type AttachmentViolation struct {
+	// Filename is the attachment name, followed by the entry path in archives, e.g. "docs.zip/invoice.exe".
+	Filename string
+	Reason   string
+}
+
+func (v AttachmentViolation) String() string {
+	if v.Filename == "" {
+		return v.Reason
+	}
+
+	return v.Filename + ": " + v.Reason
+}
+
+// AttachmentResult is the verdict of an AttachmentPolicy.
+type AttachmentResult struct {
+	// Attachments is the number of attachments, archive entries excluded.
+	Attachments int
+	Violations  []AttachmentViolation
+	// Stripped is set when the offending attachments were removed from the message.
+	Stripped bool
+}
+
+// AttachmentPolicy blocks dangerous attachments, recognized by their extension or by their content,
+// looking into zip, tar and gzip archives. See Check and Middleware.
+type AttachmentPolicy struct {
+	// MaxCount caps the number of attachments, zero means no limit.
+	MaxCount int
+	// MaxSize caps the decoded size of each attachment, zero means no limit.
+	MaxSize int64
+	// DangerousExtensions are blocked, without dot and case insensitive. It defaults to DefaultDangerousExtensions.
+	DangerousExtensions []string
+	// MaxDepth is the number of nested archives inspected, deeper archives are violations.
+	// It defaults to DefaultAttachmentDepth.
+	MaxDepth int
+	// Strip removes the offending attachments, replaced with a notice, instead of rejecting the message.
+	// Too many attachments, and a message which is itself an offending attachment, are still rejected.
+	Strip bool
+	// Reply is replied to rejected messages, it defaults to a 554 5.7.1 naming the first violation.
+	Reply *smtp.SMTPError
+}
+
+// Check inspects the attachments of the message. When Strip is set the offending ones are removed
+// from the message, which the handler then reads without them.
+func (p *AttachmentPolicy) Check(c *Context) (*AttachmentResult, error) {
+	fields, body, err := readRawHeader(c.Body())
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.Join(fields, "") + "\r\n"))).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &attachmentScan{policy: p, dangerous: map[string]bool{}}
+	extensions := p.DangerousExtensions
+	if extensions == nil {
+		extensions = DefaultDangerousExtensions
+	}
+	for _, extension := range extensions {
+		scan.dangerous[strings.ToLower(strings.TrimPrefix(extension, "."))] = true
+	}
+
+	rewritten, err := scan.entity(header, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AttachmentResult{Attachments: scan.count, Violations: scan.violations}
+	tooMany := p.MaxCount > 0 && scan.count > p.MaxCount
+	if tooMany {
+		result.Violations = append(result.Violations, AttachmentViolation{
+			Reason: fmt.Sprintf("too many attachments (%d, at most %d)", scan.count, p.MaxCount),
+		})
+	}
+
+	if p.Strip && scan.stripped && !tooMany && !scan.rootViolation {
+		if err := c.session.rewriteMessage(fields, bytes.NewReader(rewritten)); err != nil {
+			return nil, err
+		}
+
+		result.Stripped = true
+	}
+
+	return result, nil
+}
+
+// Middleware checks the attachments before the handler, rejecting the message or stripping the
+// offending attachments. Messages which can't be parsed are rejected too.
+func (p *AttachmentPolicy) Middleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		result, err := p.Check(c)
+		if err != nil {
+			c.session.logger().Printf("attachment policy of %s: %v", c.QueueID(), err)
+			return p.reply("malformed MIME structure")
+		}
+
+		if len(result.Violations) > 0 && !result.Stripped {
+			return p.reply(result.Violations[0].String())
+		}
+
+		for _, violation := range result.Violations {
+			c.session.logger().Printf("attachment policy of %s: stripped %s", c.QueueID(), violation)
+		}
+
+		return next(c)
+	}
+}
+
+func (p *AttachmentPolicy) reply(violation string) error {
+	if p.Reply != nil {
+		return p.Reply
+	}
+
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Attachment not allowed: " + violation,
+	}
+}
+
+// attachmentScan walks the MIME tree of a message.
+type attachmentScan struct {
+	policy     *AttachmentPolicy
+	dangerous  map[string]bool
+	count      int
+	violations []AttachmentViolation
+	// stripped is set when a part was replaced, rootViolation when the message itself is offending.
+	stripped      bool
+	rootViolation bool
+	depth         int
+}
+
+// entity checks a MIME entity and returns its body, rewritten without the offending attachments.
+func (s *attachmentScan) entity(header textproto.MIMEHeader, body []byte) ([]byte, error) {
+	contentType, params, err := mime.ParseMediaType(sanitizeContentTypeHeader(header.Get("Content-Type")))
+	if err != nil {
+		contentType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(contentType, "multipart/") {
+		return s.multipart(body, params["boundary"])
+	}
+
+	filename := attachmentFilename(header)
+	if filename == "" && !strings.EqualFold(strings.TrimSpace(strings.Split(header.Get("Content-Disposition"), ";")[0]), "attachment") {
+		return body, nil
+	}
+
+	s.count++
+
+	decoded, err := decodeContent(bytes.NewReader(body), header.Get("Content-Transfer-Encoding"), "")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if filename == "" {
+		filename = "unnamed"
+	}
+
+	before := len(s.violations)
+	if s.policy.MaxSize > 0 && int64(len(data)) > s.policy.MaxSize {
+		s.violate(filename, fmt.Sprintf("too large (%d bytes, at most %d)", len(data), s.policy.MaxSize))
+	}
+	s.file(filename, data, 0)
+
+	if len(s.violations) == before {
+		return body, nil
+	}
+
+	if s.depth == 0 {
+		s.rootViolation = true
+	}
+
+	return nil, nil
+}
+
+// multipart checks the parts and rebuilds the body when one of them is stripped.
+func (s *attachmentScan) multipart(body []byte, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("multipart without boundary")
+	}
+
+	s.depth++
+	defer func() { s.depth-- }()
+
+	var out bytes.Buffer
+	w := multipart.NewWriter(&out)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	stripped := false
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		violations := len(s.violations)
+		rewritten, err := s.entity(part.Header, raw)
+		if err != nil {
+			return nil, err
+		}
+
+		// a leaf part with violations has no body left
+		header := part.Header
+		if rewritten == nil {
+			stripped = true
+			header, rewritten = strippedNotice(attachmentFilename(part.Header), s.violations[violations].Reason)
+		}
+
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := pw.Write(rewritten); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if !stripped && !s.stripped {
+		return body, nil
+	}
+
+	s.stripped = true
+
+	return out.Bytes(), nil
+}
+
+// strippedNotice replaces a stripped attachment.
+func strippedNotice(filename, reason string) (textproto.MIMEHeader, []byte) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "8bit")
+
+	return header, []byte(fmt.Sprintf("The attachment %q was removed: %s.", filename, reason))
+}
+
+// file checks a file by name and content, and the entries of archives.
+func (s *attachmentScan) file(name string, data []byte, depth int) {
+	base := path.Base(strings.Replace(name, "\\", "/", -1))
+	extensions := strings.Split(strings.ToLower(strings.TrimRight(base, ". ")), ".")[1:]
+
+	// only a dangerous last extension matters, report.pdf.zip or data.csv.gz are fine
+	if n := len(extensions); n > 0 {
+		last, previous := strings.TrimSpace(extensions[n-1]), ""
+		if n > 1 {
+			previous = strings.TrimSpace(extensions[n-2])
+		}
+
+		if s.dangerous[last] {
+			if documentExtensions[previous] {
+				s.violate(name, "double extension ."+previous+"."+last)
+			} else {
+				s.violate(name, "dangerous extension ."+last)
+			}
+		}
+	}
+
+	fileType := detectFileType(data)
+	if executableTypes[fileType] {
+		s.violate(name, "executable content ("+fileType+")")
+	}
+
+	switch fileType {
+	case "zip", "tar", "gzip":
+		if depth >= s.maxDepth() {
+			s.violate(name, "archives nested too deep")
+			return
+		}
+
+		if err := s.archive(name, fileType, data, depth+1); err != nil {
+			s.violate(name, "unreadable archive")
+		}
+	}
+}
+
+func (s *attachmentScan) maxDepth() int {
+	if s.policy.MaxDepth == 0 {
+		return DefaultAttachmentDepth
+	}
+
+	return s.policy.MaxDepth
+}
+
+// archive checks the entries of a zip, tar or gzip archive.
+func (s *attachmentScan) archive(name, fileType string, data []byte, depth int) error {
+	switch fileType {
+	case "zip":
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				// e.g. encrypted entries, their names are still checked
+				s.file(name+"/"+f.Name, nil, depth)
+				continue
+			}
+
+			entry, err := readExpanded(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+
+			s.file(name+"/"+f.Name, entry, depth)
+		}
+	case "tar":
+		r := tar.NewReader(bytes.NewReader(data))
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if h.Typeflag != tar.TypeReg {
+				continue
+			}
+
+			entry, err := readExpanded(r)
+			if err != nil {
+				return err
+			}
+
+			s.file(name+"/"+h.Name, entry, depth)
+		}
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		entry, err := readExpanded(r)
+		if err != nil {
+			return err
+		}
+
+		inner := r.Name
+		if inner == "" {
+			inner = strings.TrimSuffix(path.Base(name), path.Ext(name))
+		}
+
+		s.file(name+"/"+inner, entry, depth)
+	}
+
+	return nil
+}
+
+// readExpanded reads a decompressed entry, at most DefaultAttachmentExpansion bytes.
+func readExpanded(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, DefaultAttachmentExpansion+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > DefaultAttachmentExpansion {
+		return nil, fmt.Errorf("entry expands beyond %d bytes", DefaultAttachmentExpansion)
+	}
+
+	return data, nil
+}
+
+func (s *attachmentScan) violate(filename, reason string) {
+	s.violations = append(s.violations, AttachmentViolation{Filename: filename, Reason: reason})
+}
+
+// attachmentFilename returns the decoded filename of a part, from its disposition or content type.
+func attachmentFilename(header textproto.MIMEHeader) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return decodeMimeSentence(params["filename"])
+	}
+
+	if _, params, err := mime.ParseMediaType(sanitizeContentTypeHeader(header.Get("Content-Type"))); err == nil && params["name"] != "" {
+		return decodeMimeSentence(params["name"])
+	}
+
+	return ""
+}
+
+// isPE recognizes Windows executables, whose MZ header points to a PE header.
+func isPE(data []byte) bool {
+	if len(data) < 64 || !bytes.HasPrefix(data, []byte("MZ")) {
+		return false
+	}
+
+	offset := int64(binary.LittleEndian.Uint32(data[60:64]))
+
+	return offset+4 <= int64(len(data)) && bytes.Equal(data[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// detectFileType recognizes a file by its magic bytes, "" when unknown.
+func detectFileType(data []byte) string {
+	switch {
+	case isPE(data):
+		return "exe"
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		return "elf"
+	case bytes.HasPrefix(data, []byte("\xfe\xed\xfa\xce")), bytes.HasPrefix(data, []byte("\xfe\xed\xfa\xcf")),
+		bytes.HasPrefix(data, []byte("\xce\xfa\xed\xfe")), bytes.HasPrefix(data, []byte("\xcf\xfa\xed\xfe")):
+		return "mach-o"
+	case bytes.HasPrefix(data, []byte("L\x00\x00\x00\x01\x14\x02\x00")):
+		return "lnk"
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		return "gzip"
+	case len(data) >= 262 && bytes.Equal(data[257:262], []byte("ustar")):
+		return "tar"
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return "pdf"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(data, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")):
+		return "ole"
+	case bytes.HasPrefix(data, []byte("Rar!\x1a\x07")):
+		return "rar"
+	case bytes.HasPrefix(data, []byte("7z\xbc\xaf\x27\x1c")):
+		return "7z"
+	}
+
+	return ""
+}
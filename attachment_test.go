@@ -0,0 +1,182 @@
+package smtpsrv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPE is the smallest header detectFileType recognizes as a Windows executable.
+func testPE() []byte {
+	data := make([]byte, 128)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[60:], 64)
+	copy(data[64:], "PE\x00\x00")
+
+	return data
+}
+
+func testZip(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func testTarGz(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err = gw.Write(tarball.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+// testAttachmentMessage builds a multipart/mixed message with a text part and the attachments, base64 encoded,
+// with LF line endings as newTestContext expects.
+func testAttachmentMessage(attachments ...[2]string) string {
+	var b strings.Builder
+	b.WriteString("From: sender@example.org\nSubject: files\nMIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=\"b1\"\n\n")
+	b.WriteString("--b1\nContent-Type: text/plain\n\nsee attached\n")
+
+	for _, attachment := range attachments {
+		fmt.Fprintf(&b, "--b1\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=\"%s\"\nContent-Transfer-Encoding: base64\n\n%s\n",
+			attachment[0], base64.StdEncoding.EncodeToString([]byte(attachment[1])))
+	}
+	b.WriteString("--b1--\n")
+
+	return b.String()
+}
+
+func TestAttachmentPolicy(t *testing.T) {
+	nested := testZip(t, map[string][]byte{"inner.zip": testZip(t, map[string][]byte{"deep.zip": testZip(t, map[string][]byte{"a.txt": []byte("a")})})})
+
+	tests := []struct {
+		name        string
+		policy      AttachmentPolicy
+		attachments [][2]string
+		want        []string
+	}{
+		{name: "clean", attachments: [][2]string{{"report.pdf", "%PDF-1.4"}, {"notes.txt", "hello"}}},
+		{name: "dangerous extension", attachments: [][2]string{{"setup.EXE", "hello"}}, want: []string{"setup.EXE: dangerous extension .exe"}},
+		{name: "double extension", attachments: [][2]string{{"invoice.pdf .exe", "hello"}}, want: []string{"invoice.pdf .exe: double extension .pdf.exe"}},
+		{name: "archived document", attachments: [][2]string{{"data.csv.gz", "hello"}, {"report.pdf.zip", "hello"}, {"page.pdf.html5", "hello"}}},
+		{name: "executable content", attachments: [][2]string{{"photo.jpg", string(testPE())}}, want: []string{"photo.jpg: executable content (exe)"}},
+		{
+			name:        "executable in zip",
+			attachments: [][2]string{{"docs.zip", string(testZip(t, map[string][]byte{"invoice.pdf.scr": []byte("x")}))}},
+			want:        []string{"docs.zip/invoice.pdf.scr: double extension .pdf.scr"},
+		},
+		{
+			name:        "executable in tar.gz",
+			attachments: [][2]string{{"backup.tar.gz", string(testTarGz(t, "bin/tool", []byte("\x7fELF...")))}},
+			want:        []string{"backup.tar.gz/backup.tar/bin/tool: executable content (elf)"},
+		},
+		{
+			name:        "archives nested too deep",
+			policy:      AttachmentPolicy{MaxDepth: 2},
+			attachments: [][2]string{{"nested.zip", string(nested)}},
+			want:        []string{"nested.zip/inner.zip/deep.zip: archives nested too deep"},
+		},
+		{name: "too large", policy: AttachmentPolicy{MaxSize: 4}, attachments: [][2]string{{"a.txt", "hello"}}, want: []string{"a.txt: too large (5 bytes, at most 4)"}},
+		{
+			name:        "too many",
+			policy:      AttachmentPolicy{MaxCount: 1},
+			attachments: [][2]string{{"a.txt", "a"}, {"b.txt", "b"}},
+			want:        []string{"too many attachments (2, at most 1)"},
+		},
+		{name: "custom extensions", policy: AttachmentPolicy{DangerousExtensions: []string{".txt"}}, attachments: [][2]string{{"setup.exe", "x"}, {"a.txt", "a"}}, want: []string{"a.txt: dangerous extension .txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, &ServerConfig{}, testAttachmentMessage(tt.attachments...))
+
+			result, err := tt.policy.Check(c)
+			require.NoError(t, err)
+			require.Equal(t, len(tt.attachments), result.Attachments)
+
+			var violations []string
+			for _, violation := range result.Violations {
+				violations = append(violations, violation.String())
+			}
+			require.Equal(t, tt.want, violations)
+		})
+	}
+}
+
+func TestAttachmentPolicyStrip(t *testing.T) {
+	policy := &AttachmentPolicy{Strip: true}
+	c := newTestContext(t, &ServerConfig{}, testAttachmentMessage([2]string{"setup.exe", "x"}, [2]string{"notes.txt", "hello"}))
+
+	result, err := policy.Check(c)
+	require.NoError(t, err)
+	require.True(t, result.Stripped)
+
+	email, err := c.Parse()
+	require.NoError(t, err)
+	require.Equal(t, "files", email.Subject)
+	require.Equal(t, "see attachedThe attachment \"setup.exe\" was removed: dangerous extension .exe.", email.TextBody)
+	require.Len(t, email.Attachments, 1)
+	require.Equal(t, "notes.txt", email.Attachments[0].Filename)
+
+	body, err := ioutil.ReadAll(c.Body())
+	require.NoError(t, err)
+	require.Contains(t, string(body), base64.StdEncoding.EncodeToString([]byte("hello")))
+	require.NotContains(t, string(body), base64.StdEncoding.EncodeToString([]byte("x")))
+}
+
+func TestAttachmentPolicyMiddleware(t *testing.T) {
+	handled := make(chan string, 1)
+	addr := startTestServer(t, &ServerConfig{
+		Middlewares: []Middleware{(&AttachmentPolicy{}).Middleware},
+		Handler: func(c *Context) error {
+			handled <- c.QueueID()
+			return nil
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+
+	code, msg := command(t, c, "%s.", strings.Replace(testAttachmentMessage([2]string{"game.scr", "x"}), "\n", "\r\n", -1))
+	require.Equal(t, 554, code)
+	require.Equal(t, "5.7.1 Attachment not allowed: game.scr: dangerous extension .scr", msg)
+	require.Len(t, handled, 0)
+}
@@ -0,0 +1,181 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zaccone/spf"
+)
+
+// AuthResults builds an Authentication-Results header field, as in RFC 8601.
+type AuthResults struct {
+	// AuthServID names the server which performed the checks, e.g. the BannerDomain.
+	AuthServID string
+
+	results []string
+}
+
+// NewAuthResults returns an empty builder, an empty result set is reported as "none".
+func NewAuthResults(authServID string) *AuthResults {
+	return &AuthResults{AuthServID: authServID}
+}
+
+// Add appends a result, e.g. Add("spf", "pass", "", "smtp.mailfrom=sender@example.org").
+// The optional reason is quoted and the properties are added as is.
+func (ar *AuthResults) Add(method, result, reason string, properties ...string) *AuthResults {
+	parts := []string{method + "=" + result}
+	if reason != "" {
+		parts = append(parts, "reason="+quoteValue(reason))
+	}
+
+	ar.results = append(ar.results, strings.Join(append(parts, properties...), " "))
+
+	return ar
+}
+
+// Results returns the results without the authserv-id, e.g. for an ARC-Authentication-Results.
+func (ar *AuthResults) Results() string {
+	if len(ar.results) == 0 {
+		return "none"
+	}
+
+	return strings.Join(ar.results, ";\r\n\t")
+}
+
+// String returns the header field, ready to be prepended to the message.
+func (ar *AuthResults) String() string {
+	return "Authentication-Results: " + ar.AuthServID + ";\r\n\t" + ar.Results() + "\r\n"
+}
+
+// quoteValue quotes s as an RFC 5322 quoted-string.
+func quoteValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// AuthResults builds the Authentication-Results of the checks which already ran in the transaction
+// (FCrDNS, SPF, DKIM, DMARC and ARC) along with the SMTP AUTH status, stamped with the BannerDomain.
+// Run the wanted checks first, e.g. c.SPF() and c.DMARC().
+func (c Context) AuthResults() *AuthResults {
+	ar := NewAuthResults(c.session.config.BannerDomain)
+
+	if c.session.authenticated {
+		ar.Add("auth", "pass", "", "smtp.auth="+*c.session.username)
+	}
+
+	if rdns := c.session.rdns; rdns != nil && c.RemoteIP() != nil {
+		var comment string
+		if rdns.Hostname != "" {
+			comment = " (" + rdns.Hostname + ")"
+		}
+
+		ar.Add("iprev", string(rdns.Status)+comment, "", "policy.iprev="+c.RemoteIP().String())
+	}
+
+	tx := c.session.transaction()
+
+	if check := tx.spf; check != nil {
+		property := "smtp.mailfrom=" + check.sender
+		if check.identity == "helo" {
+			property = "smtp.helo=" + check.helo
+		}
+
+		var reason string
+		if check.err != nil && check.result != spf.None {
+			reason = check.err.Error()
+		}
+
+		ar.Add("spf", check.result.String(), reason, property)
+	}
+
+	for _, result := range tx.dkim {
+		var reason string
+		if result.Err != nil {
+			reason = result.Err.Error()
+		}
+
+		ar.Add("dkim", string(result.Status), reason,
+			"header.d="+result.Domain, "header.s="+result.Selector, "header.i="+result.Identifier, "header.a="+result.Algorithm)
+	}
+
+	if result := tx.dmarc; result != nil && result.Domain != "" {
+		status := string(result.Status)
+		if result.Policy != "" {
+			status += " (p=" + string(result.Policy) + ")"
+		}
+
+		ar.Add("dmarc", status, "", "header.from="+result.Domain)
+	}
+
+	if result := tx.arc; result != nil {
+		status := string(result.Status)
+		if result.Instances > 0 {
+			status += fmt.Sprintf(" (i=%d)", result.Instances)
+		}
+
+		ar.Add("arc", status, "")
+	}
+
+	return ar
+}
+
+// stripAuthResults copies the message from r to w without the Authentication-Results header fields
+// claiming authServID, which can only be forged as we add ours later. It reports whether any was stripped,
+// an unparsable header is left untouched for the handler to deal with.
+func stripAuthResults(w io.Writer, r io.Reader, authServID string) (bool, error) {
+	fields, body, err := readRawHeader(r)
+	if err != nil {
+		return false, nil
+	}
+
+	stripped := false
+	for _, field := range fields {
+		if strings.EqualFold(fieldName(field), "Authentication-Results") && strings.EqualFold(authResultsServID(field), authServID) {
+			stripped = true
+			continue
+		}
+
+		if _, err := io.WriteString(w, field); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := io.WriteString(w, "\r\n"); err != nil {
+		return false, err
+	}
+
+	_, err = io.Copy(w, body)
+
+	return stripped, err
+}
+
+// authResultsServID returns the authserv-id of an Authentication-Results field, without its optional version.
+func authResultsServID(field string) string {
+	value := fieldValue(field)
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+
+	if fields := strings.Fields(value); len(fields) > 0 {
+		return fields[0]
+	}
+
+	return ""
+}
+
+// stripAuthResults replaces the spooled message by a copy without our forged Authentication-Results.
+func (s *Session) stripAuthResults() error {
+	tx := s.transaction()
+
+	body := newSpool(s.config.SpoolDir, s.config.SpoolThreshold)
+
+	stripped, err := stripAuthResults(body, tx.body.Reader(), s.config.BannerDomain)
+	if err != nil || !stripped {
+		body.Close()
+		return err
+	}
+
+	tx.replaceBody(body)
+
+	return nil
+}
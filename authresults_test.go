@@ -0,0 +1,103 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zaccone/spf"
+)
+
+func TestAuthResults(t *testing.T) {
+	ar := NewAuthResults("mx.example.com")
+	require.Equal(t, "Authentication-Results: mx.example.com;\r\n\tnone\r\n", ar.String())
+
+	ar.Add("spf", "pass", "", "smtp.mailfrom=sender@example.org").
+		Add("dkim", "fail", `bad "signature"`, "header.d=example.org")
+	require.Equal(t, "Authentication-Results: mx.example.com;\r\n"+
+		"\tspf=pass smtp.mailfrom=sender@example.org;\r\n"+
+		"\tdkim=fail reason=\"bad \\\"signature\\\"\" header.d=example.org\r\n", ar.String())
+}
+
+func TestContextAuthResults(t *testing.T) {
+	c := newTestContext(t, &ServerConfig{BannerDomain: "mx.example.com"}, "From: sender@example.org\n\nbody\n")
+
+	c.session.auther = func(username, password string) error { return nil }
+	require.NoError(t, c.session.AuthPlain("alice", "secret"))
+
+	tx := c.session.transaction()
+	tx.spf = &spfCheck{result: spf.Pass, identity: "mailfrom", sender: "sender@example.org"}
+	tx.dkim = []DKIMResult{
+		{Status: DKIMPass, Domain: "example.org", Selector: "s1", Identifier: "@example.org", Algorithm: "rsa-sha256"},
+		{Status: DKIMFail, Domain: "example.net", Selector: "s2", Identifier: "@example.net", Algorithm: "ed25519-sha256", Err: errors.New("body hash mismatch")},
+	}
+	tx.dmarc = &DMARCResult{Status: DMARCPass, Domain: "example.org", Policy: DMARCPolicyReject}
+	tx.arc = &ARCResult{Status: ARCPass, Instances: 2}
+
+	require.Equal(t, "Authentication-Results: mx.example.com;\r\n"+
+		"\tauth=pass smtp.auth=alice;\r\n"+
+		"\tspf=pass smtp.mailfrom=sender@example.org;\r\n"+
+		"\tdkim=pass header.d=example.org header.s=s1 header.i=@example.org header.a=rsa-sha256;\r\n"+
+		"\tdkim=fail reason=\"body hash mismatch\" header.d=example.net header.s=s2 header.i=@example.net header.a=ed25519-sha256;\r\n"+
+		"\tdmarc=pass (p=reject) header.from=example.org;\r\n"+
+		"\tarc=pass (i=2)\r\n", c.AuthResults().String())
+}
+
+func TestContextAuthResultsFailedAuth(t *testing.T) {
+	c := newTestContext(t, &ServerConfig{BannerDomain: "mx.example.com"}, "From: sender@example.org\n\nbody\n")
+
+	denied := errors.New("invalid credentials")
+	c.session.auther = func(username, password string) error { return denied }
+	require.Equal(t, denied, c.session.AuthPlain("alice", "wrong"))
+
+	require.Equal(t, "Authentication-Results: mx.example.com;\r\n\tnone\r\n", c.AuthResults().String())
+}
+
+func TestStripAuthResults(t *testing.T) {
+	message := "Authentication-Results: MX.example.com; spf=pass\r\n" +
+		"Authentication-Results: mx.example.com 1;\r\n\tdkim=pass\r\n" +
+		"Authentication-Results: relay.example.net; spf=pass\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.com; body\r\n"
+
+	var w bytes.Buffer
+	stripped, err := stripAuthResults(&w, bytes.NewReader([]byte(message)), "mx.example.com")
+	require.NoError(t, err)
+	require.True(t, stripped)
+	require.Equal(t, "Authentication-Results: relay.example.net; spf=pass\r\n"+
+		"Subject: test\r\n"+
+		"\r\n"+
+		"Authentication-Results: mx.example.com; body\r\n", w.String())
+}
+
+func TestStripAuthResultsOption(t *testing.T) {
+	body := make(chan []byte, 1)
+
+	addr := startTestServer(t, &ServerConfig{
+		StripAuthResults: true,
+		Handler: func(c *Context) error {
+			b, err := ioutil.ReadAll(c.Body())
+			body <- b
+			return err
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+	code, _ = command(t, c, "Authentication-Results: mx.example.com; spf=pass\r\nSubject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	require.Equal(t, "Subject: test\r\n\r\nbody\r\n", string(<-body))
+}
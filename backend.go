@@ -8,16 +8,73 @@ import (
 type Backend struct {
 	handler HandlerFunc
 	auther  AuthFunc
+	config  *ServerConfig
 }
 
 func NewBackend(auther AuthFunc, handler HandlerFunc) *Backend {
 	return &Backend{
 		handler: handler,
 		auther:  auther,
+		config:  &ServerConfig{},
 	}
 }
 
 // NewSession creates a new session for the given connection.
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return NewSession(c, bkd.handler), nil
+	s := NewSession(c, bkd.handler)
+	s.config = bkd.config
+	s.auther = bkd.auther
+	s.helo = c.Hostname()
+
+	var prev *Session
+	cn := connOf(c.Conn())
+	if cn != nil {
+		s.dnsbl = cn.dnsbl
+		s.pregreet, s.pipelining = cn.pregreet, cn.pipelining
+		s.done = cn.done
+		prev = cn.currentSession()
+	}
+
+	// a new HELO, e.g. after STARTTLS, keeps the connection state: the tarpit, the metadata
+	// and the reverse DNS, compared again to the new HELO name
+	if prev != nil {
+		s.rejectedRcpts = prev.rejectedRcpts
+		s.meta.copyFrom(&prev.meta)
+
+		if prev.rdns != nil {
+			rdns := *prev.rdns
+			rdns.HeloMatch = rdns.Hostname != "" && normalizeName(s.helo) == rdns.Hostname
+			s.rdns = &rdns
+		}
+	}
+
+	if s.pipelining && s.config.RejectEarlyTalkers {
+		return nil, ErrIllegalPipelining
+	}
+
+	ctx := Context{session: s}
+	for _, policy := range s.config.HeloPolicies {
+		if err := policy(&ctx, s.helo); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.milterHelo(prev); err != nil {
+		s.milterQuit()
+		return nil, err
+	}
+
+	// a rejected HELO leaves the previous session in place, with its milters
+	if cn != nil {
+		cn.setSession(s)
+	}
+
+	return s, nil
+}
+
+func newBackend(cfg *ServerConfig) *Backend {
+	bkd := NewBackend(cfg.Auther, cfg.Handler)
+	bkd.config = cfg
+
+	return bkd
 }
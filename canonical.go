@@ -0,0 +1,204 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// readRawHeader reads the header fields of a message as received, each one including its folding
+// and a CRLF line ending. The returned reader is positioned at the start of the body.
+func readRawHeader(r io.Reader) ([]string, *bufio.Reader, error) {
+	br := bufio.NewReader(r)
+
+	var fields []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return fields, br, nil
+		}
+
+		// continuation lines start with white space
+		if len(fields) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line + "\r\n"
+		} else {
+			fields = append(fields, line+"\r\n")
+		}
+
+		if err == io.EOF {
+			return fields, br, nil
+		}
+	}
+}
+
+// fieldName returns the name of a raw header field.
+func fieldName(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return strings.TrimSpace(field)
+	}
+
+	return strings.TrimRight(field[:i], " \t")
+}
+
+// fieldValue returns the unfolded value of a raw header field.
+func fieldValue(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(field[i+1:]))
+}
+
+// canonicalizeHeader returns a raw header field in its simple or relaxed canonical form, as in RFC 6376 section 3.4.
+func canonicalizeHeader(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return field
+	}
+
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(field[i+1:])
+	value = strings.Trim(collapseWhitespace(value), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// collapseWhitespace replaces every run of spaces and tabs with a single space.
+func collapseWhitespace(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+// canonicalizeBody writes the simple or relaxed canonical form of the body read from r to w,
+// stopping after limit bytes if limit isn't negative.
+func canonicalizeBody(w io.Writer, r *bufio.Reader, relaxed bool, limit int64) error {
+	if limit >= 0 {
+		w = &limitWriter{w: w, n: limit}
+	}
+
+	// empty lines are only written once followed by some content
+	empty, written := 0, false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if err == io.EOF && line == "" {
+			break
+		}
+
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if relaxed {
+			line = strings.TrimRight(collapseWhitespace(line), " ")
+		}
+
+		if line == "" {
+			empty++
+		} else {
+			if _, err := io.WriteString(w, strings.Repeat("\r\n", empty)+line+"\r\n"); err != nil {
+				return err
+			}
+
+			empty, written = 0, true
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if !written && !relaxed {
+		_, err := io.WriteString(w, "\r\n")
+		return err
+	}
+
+	return nil
+}
+
+// limitWriter silently discards everything written past n bytes.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	size := len(p)
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	return size, nil
+}
+
+// parseTagList parses a DKIM style tag=value list, as in RFC 6376 section 3.2.
+func parseTagList(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.IndexByte(spec, '=')
+		if i < 0 {
+			return nil, errMalformedTagList
+		}
+
+		name := strings.TrimSpace(spec[:i])
+		if _, ok := tags[name]; ok {
+			return nil, errMalformedTagList
+		}
+
+		tags[name] = strings.TrimSpace(spec[i+1:])
+	}
+
+	return tags, nil
+}
+
+// stripWhitespace removes all the white space of s, e.g. a folded base64 value.
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+
+		return r
+	}, s)
+}
@@ -0,0 +1,225 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultClamAVTimeout bounds a scan when ClamAV.Timeout is zero.
+const DefaultClamAVTimeout = time.Minute
+
+// ErrVirusScanFailed is replied when clamd fails and the scanner isn't FailOpen.
+var ErrVirusScanFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Virus scan failed, try again later",
+}
+
+// clamavChunkSize is the size of the INSTREAM chunks, well below the clamd StreamMaxLength.
+const clamavChunkSize = 64 * 1024
+
+// VirusScanResult is the verdict of a virus scan.
+type VirusScanResult struct {
+	Infected bool
+	// Signature names the malware found, e.g. "Eicar-Test-Signature".
+	Signature string
+}
+
+// ClamAV scans messages with clamd over TCP or a unix socket with the INSTREAM command.
+type ClamAV struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout bounds a scan, it defaults to DefaultClamAVTimeout.
+	Timeout time.Duration
+	// FailOpen accepts messages when clamd fails, instead of a 451.
+	FailOpen bool
+}
+
+// Scan streams r to clamd and returns its verdict.
+func (s *ClamAV) Scan(r io.Reader) (*VirusScanResult, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultClamAVTimeout
+	}
+
+	conn, err := net.DialTimeout(s.Network, s.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriterSize(conn, clamavChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return nil, err
+	}
+
+	chunk := make([]byte, clamavChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+				return nil, err
+			}
+
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return nil, err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a zero length chunk ends the stream
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply parses "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+func parseClamdReply(reply string) (*VirusScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(signature, ": "); i >= 0 {
+			signature = signature[i+2:]
+		}
+
+		return &VirusScanResult{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return &VirusScanResult{}, nil
+	}
+
+	return nil, fmt.Errorf("clamd: %s", reply)
+}
+
+// Middleware scans the message before the handler, infected messages are rejected with a 554 5.7.1
+// naming the signature. The verdict is on Context.VirusScan.
+func (s *ClamAV) Middleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		result, err := s.Scan(c.Body())
+		if err != nil {
+			c.session.logger().Printf("clamav scan of %s: %v", c.QueueID(), err)
+			if s.FailOpen {
+				return next(c)
+			}
+
+			return ErrVirusScanFailed
+		}
+
+		c.session.transaction().virus = result
+
+		if result.Infected {
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected, virus found: " + result.Signature,
+			}
+		}
+
+		return next(c)
+	}
+}
+
+// VirusScan returns the verdict of the virus scan, nil when the message wasn't scanned.
+func (c Context) VirusScan() *VirusScanResult {
+	if c.session.tx == nil {
+		return nil
+	}
+
+	return c.session.tx.virus
+}
+
+// FakeClamd answers INSTREAM scans like clamd, e.g. in tests: a stream containing one of the
+// Signatures keys is infected by its value.
+type FakeClamd struct {
+	Signatures map[string]string
+	// Fail replies an error to every scan.
+	Fail bool
+}
+
+// Serve answers the connections of l until it's closed.
+func (f *FakeClamd) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go f.serve(conn)
+	}
+}
+
+func (f *FakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	if command != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		if size == 0 {
+			break
+		}
+
+		if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+			return
+		}
+	}
+
+	if f.Fail {
+		io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+		return
+	}
+
+	for pattern, signature := range f.Signatures {
+		if bytes.Contains(stream.Bytes(), []byte(pattern)) {
+			io.WriteString(conn, "stream: "+signature+" FOUND\x00")
+			return
+		}
+	}
+
+	io.WriteString(conn, "stream: OK\x00")
+}
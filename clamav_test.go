@@ -0,0 +1,99 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testEICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func startFakeClamd(t *testing.T, f *FakeClamd) *ClamAV {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go f.Serve(l)
+
+	return &ClamAV{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	result, err := parseClamdReply("stream: OK\x00")
+	require.NoError(t, err)
+	require.Equal(t, &VirusScanResult{}, result)
+
+	result, err = parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND\x00")
+	require.NoError(t, err)
+	require.Equal(t, &VirusScanResult{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, result)
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR\x00")
+	require.EqualError(t, err, "clamd: INSTREAM size limit exceeded. ERROR")
+}
+
+func TestClamAVScan(t *testing.T) {
+	scanner := startFakeClamd(t, &FakeClamd{Signatures: map[string]string{testEICAR: "Eicar-Test-Signature"}})
+
+	result, err := scanner.Scan(strings.NewReader("Subject: clean\r\n\r\nHi.\r\n"))
+	require.NoError(t, err)
+	require.False(t, result.Infected)
+
+	// larger than a chunk, with the signature across two of them
+	message := bytes.Repeat([]byte("a"), clamavChunkSize-10)
+	message = append(message, testEICAR...)
+	result, err = scanner.Scan(bytes.NewReader(message))
+	require.NoError(t, err)
+	require.Equal(t, &VirusScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, result)
+}
+
+func TestClamAVMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		clamd    *FakeClamd
+		failOpen bool
+		message  string
+		code     int
+		msg      string
+	}{
+		{name: "clean", clamd: &FakeClamd{}, message: "Subject: test\r\n\r\nHi.\r\n", code: 250},
+		{name: "infected", clamd: &FakeClamd{Signatures: map[string]string{testEICAR: "Eicar-Test-Signature"}},
+			message: "Subject: test\r\n\r\n" + testEICAR + "\r\n", code: 554, msg: "5.7.1 Message rejected, virus found: Eicar-Test-Signature"},
+		{name: "failure", clamd: &FakeClamd{Fail: true}, message: "Subject: test\r\n\r\nHi.\r\n", code: 451},
+		{name: "failure accepted", clamd: &FakeClamd{Fail: true}, failOpen: true, message: "Subject: test\r\n\r\nHi.\r\n", code: 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := startFakeClamd(t, tt.clamd)
+			scanner.FailOpen = tt.failOpen
+
+			addr := startTestServer(t, &ServerConfig{
+				Middlewares: []Middleware{scanner.Middleware},
+				Handler:     func(c *Context) error { return nil },
+			})
+
+			c, code, _ := dialTestServer(t, addr)
+			require.Equal(t, 220, code)
+
+			code, _ = command(t, c, "EHLO client.example.org")
+			require.Equal(t, 250, code)
+			code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+			require.Equal(t, 250, code)
+			code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+			require.Equal(t, 250, code)
+			code, _ = command(t, c, "DATA")
+			require.Equal(t, 354, code)
+
+			code, msg := command(t, c, "%s.", tt.message)
+			require.Equal(t, tt.code, code)
+			if tt.msg != "" {
+				require.Equal(t, tt.msg, msg)
+			}
+		})
+	}
+}
@@ -1,11 +1,11 @@
 package smtpsrv
 
 import (
+	"bytes"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/mail"
-
-	"github.com/zaccone/spf"
 )
 
 type Context struct {
@@ -20,6 +20,26 @@ func (c Context) To() *mail.Address {
 	return c.session.To
 }
 
+// Recipients returns every accepted RCPT TO of the transaction, To being the last one.
+func (c Context) Recipients() []*mail.Address {
+	return c.session.recipients
+}
+
+// QueueID identifies the current transaction, e.g. in logs.
+func (c Context) QueueID() string {
+	return c.session.transaction().id
+}
+
+// Meta holds values for the whole connection.
+func (c Context) Meta() *Metadata {
+	return c.session.Meta()
+}
+
+// TxMeta holds values for the current transaction only.
+func (c Context) TxMeta() *Metadata {
+	return c.session.TxMeta()
+}
+
 func (c Context) User() (string, string, error) {
 	if c.session.username == nil || c.session.password == nil {
 		return "", "", ErrAuthDisabled
@@ -28,11 +48,39 @@ func (c Context) User() (string, string, error) {
 	return *c.session.username, *c.session.password, nil
 }
 
+// Helo returns the hostname the client introduced itself with on HELO/EHLO.
+func (c Context) Helo() string {
+	return c.session.helo
+}
+
 func (c Context) RemoteAddr() net.Addr {
 	return c.session.conn.Conn().RemoteAddr()
 }
 
+// RemoteIP returns the IP address of the client, or nil if unknown.
+func (c Context) RemoteIP() net.IP {
+	if c.session.conn == nil {
+		return nil
+	}
+
+	switch addr := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+
+		return net.ParseIP(host)
+	}
+}
+
 func (c Context) TLS() *tls.ConnectionState {
+	if c.session.conn == nil {
+		return nil
+	}
+
 	state, ok := c.session.conn.TLSConnectionState()
 	if !ok {
 		return nil
@@ -41,32 +89,51 @@ func (c Context) TLS() *tls.ConnectionState {
 	return &state
 }
 
+// Read reads the raw message, it doesn't affect the readers returned by Body.
 func (c Context) Read(p []byte) (int, error) {
-	return c.session.body.Read(p)
+	tx := c.session.transaction()
+	if tx.reader == nil {
+		tx.reader = c.Body()
+	}
+
+	return tx.reader.Read(p)
 }
 
-func (c Context) Parse() (*Email, error) {
-	return ParseEmail(c.session.body)
+// Body returns a new reader over the raw message on every call.
+func (c Context) Body() io.ReadSeeker {
+	tx := c.session.transaction()
+	if tx.body == nil {
+		return bytes.NewReader(nil)
+	}
+
+	return tx.body.Reader()
 }
 
-func (c Context) Mailable() (bool, error) {
-	_, host, err := SplitAddress(c.From().Address)
-	if err != nil {
-		return false, err
+// Header parses only the message header once, the body stays unread.
+// The returned Email has no body fields nor attachments.
+func (c Context) Header() (*Email, error) {
+	tx := c.session.transaction()
+	if tx.header == nil && tx.headerErr == nil {
+		tx.header, tx.headerErr = ParseHeader(c.Body())
 	}
 
-	mxhosts, err := net.LookupMX(host)
-	if err != nil {
-		return false, err
+	return tx.header, tx.headerErr
+}
+
+// Parse parses the message once, later calls return the same result.
+func (c Context) Parse() (*Email, error) {
+	tx := c.session.transaction()
+	if tx.email == nil && tx.emailErr == nil {
+		tx.email, tx.emailErr = ParseEmail(c.Body())
 	}
 
-	return len(mxhosts) > 0, nil
+	return tx.email, tx.emailErr
 }
+
+// SPF evaluates SPF for the client IP and the envelope sender, falling back to the HELO identity
+// for the null sender. It runs once per transaction and returns the result, explanation and error.
 func (c Context) SPF() (SPFResult, string, error) {
-	_, host, err := SplitAddress(c.From().Address)
-	if err != nil {
-		return spf.None, "", err
-	}
+	check := c.spf()
 
-	return spf.CheckHost(net.ParseIP(c.RemoteAddr().String()), host, c.From().Address)
+	return check.result, check.explanation, check.err
 }
@@ -0,0 +1,415 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMStatus is the outcome of a DKIM signature verification, as used in Authentication-Results.
+type DKIMStatus string
+
+const (
+	DKIMPass      DKIMStatus = "pass"
+	DKIMFail      DKIMStatus = "fail"
+	DKIMTemperror DKIMStatus = "temperror"
+	DKIMPermerror DKIMStatus = "permerror"
+)
+
+// DKIMResult is the verification outcome of a single DKIM-Signature header.
+type DKIMResult struct {
+	Status     DKIMStatus
+	Domain     string
+	Selector   string
+	Identifier string
+	Algorithm  string
+
+	// Err is the failure reason, it is nil on pass.
+	Err error
+}
+
+var (
+	errMalformedTagList = errors.New("malformed tag list")
+
+	// the b= tag value, but not bh=, of a signature header value
+	signatureValueRe = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+// dkimKey is a public key published in a DKIM key record.
+type dkimKey struct {
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+}
+
+// VerifyDKIM verifies every DKIM-Signature header of the message, fetching the keys through resolver.
+// The error is only about reading the message, the verification errors are part of each result.
+func VerifyDKIM(ctx context.Context, r io.ReadSeeker, resolver Resolver) ([]DKIMResult, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	fields, _, err := readRawHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []DKIMResult
+	for _, field := range fields {
+		if strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			results = append(results, verifyDKIMSignature(ctx, r, fields, field, resolver))
+		}
+	}
+
+	return results, nil
+}
+
+func verifyDKIMSignature(ctx context.Context, r io.ReadSeeker, fields []string, signature string, resolver Resolver) (result DKIMResult) {
+	fail := func(status DKIMStatus, err error) DKIMResult {
+		result.Status, result.Err = status, err
+		return result
+	}
+
+	tags, err := parseTagList(fieldValue(signature))
+	if err != nil {
+		return fail(DKIMPermerror, err)
+	}
+
+	result.Domain = strings.ToLower(tags["d"])
+	result.Selector = tags["s"]
+	result.Identifier = tags["i"]
+	result.Algorithm = tags["a"]
+
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return fail(DKIMPermerror, fmt.Errorf("missing %s= tag", name))
+		}
+	}
+
+	if tags["v"] != "1" {
+		return fail(DKIMPermerror, fmt.Errorf("unsupported version %q", tags["v"]))
+	}
+
+	if result.Identifier == "" {
+		result.Identifier = "@" + result.Domain
+	} else if _, domain, _ := SplitAddress(result.Identifier); !isSubdomain(strings.ToLower(domain), result.Domain) {
+		return fail(DKIMPermerror, errors.New("identifier isn't within the signing domain"))
+	}
+
+	if q, ok := tags["q"]; ok && !strings.Contains(q, "dns/txt") {
+		return fail(DKIMPermerror, fmt.Errorf("unsupported query method %q", q))
+	}
+
+	if x, ok := tags["x"]; ok {
+		expiration, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(DKIMPermerror, errors.New("malformed x= tag"))
+		}
+
+		if time.Now().Unix() > expiration {
+			return fail(DKIMPermerror, errors.New("signature expired"))
+		}
+	}
+
+	if !containsFold(splitHeaderNames(tags["h"]), "From") {
+		return fail(DKIMPermerror, errors.New("From isn't signed"))
+	}
+
+	result.Status, result.Err = verifyMessageSignature(ctx, r, fields, signature, tags, resolver)
+
+	return result
+}
+
+// verifyMessageSignature checks a DKIM style signature of the header fields and the body,
+// it is shared by DKIM-Signature and ARC-Message-Signature.
+func verifyMessageSignature(ctx context.Context, r io.ReadSeeker, fields []string, signature string, tags map[string]string, resolver Resolver) (DKIMStatus, error) {
+	headerRelaxed, bodyRelaxed, err := parseCanonicalization(tags["c"])
+	if err != nil {
+		return DKIMPermerror, err
+	}
+
+	limit := int64(-1)
+	if l, ok := tags["l"]; ok {
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			return DKIMPermerror, errors.New("malformed l= tag")
+		}
+	}
+
+	key, status, err := lookupDKIMKey(ctx, resolver, tags["s"], strings.ToLower(tags["d"]))
+	if err != nil {
+		return status, err
+	}
+
+	bodyHash, err := computeBodyHash(r, bodyRelaxed, limit)
+	if err != nil {
+		return DKIMTemperror, err
+	}
+
+	if expected, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"])); err != nil || !bytes.Equal(expected, bodyHash) {
+		return DKIMFail, errors.New("body hash mismatch")
+	}
+
+	hashed := computeHeaderHash(fields, splitHeaderNames(tags["h"]), signature, headerRelaxed)
+	if err := key.verify(tags["a"], hashed, tags["b"]); err != nil {
+		return DKIMFail, err
+	}
+
+	return DKIMPass, nil
+}
+
+// lookupDKIMKey fetches the key record at <selector>._domainkey.<domain>.
+func lookupDKIMKey(ctx context.Context, resolver Resolver, selector, domain string) (*dkimKey, DKIMStatus, error) {
+	records, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if isNotFound(err) {
+		return nil, DKIMPermerror, errors.New("no key for signature")
+	} else if err != nil {
+		return nil, DKIMTemperror, fmt.Errorf("key unavailable: %v", err)
+	}
+
+	err = errors.New("no key for signature")
+	for _, record := range records {
+		var key *dkimKey
+		if key, err = parseDKIMKey(record); err == nil {
+			return key, "", nil
+		}
+	}
+
+	return nil, DKIMPermerror, err
+}
+
+func parseDKIMKey(record string) (*dkimKey, error) {
+	tags, err := parseTagList(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported key version %q", v)
+	}
+
+	if h, ok := tags["h"]; ok && !containsFold(splitHeaderNames(h), "sha256") {
+		return nil, errors.New("key doesn't allow sha256")
+	}
+
+	p := stripWhitespace(tags["p"])
+	if p == "" {
+		return nil, errors.New("key revoked")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed key")
+	}
+
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// some records publish a bare PKCS#1 key
+			pub, err = x509.ParsePKCS1PublicKey(data)
+		}
+
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if err != nil || !ok {
+			return nil, errors.New("malformed RSA key")
+		}
+
+		if rsaKey.N.BitLen() < 1024 {
+			return nil, errors.New("RSA key too short")
+		}
+
+		return &dkimKey{rsa: rsaKey}, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed ed25519 key")
+		}
+
+		return &dkimKey{ed25519: ed25519.PublicKey(data)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k)
+	}
+}
+
+// verify checks the base64 signature of the hashed headers with the algorithm of the signature.
+func (key *dkimKey) verify(algorithm string, hashed []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(stripWhitespace(signature))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+
+	switch {
+	case algorithm == "rsa-sha256" && key.rsa != nil:
+		if err := rsa.VerifyPKCS1v15(key.rsa, crypto.SHA256, hashed, sig); err != nil {
+			return errors.New("signature mismatch")
+		}
+	case algorithm == "ed25519-sha256" && key.ed25519 != nil:
+		if !ed25519.Verify(key.ed25519, hashed, sig) {
+			return errors.New("signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q for key", algorithm)
+	}
+
+	return nil
+}
+
+// computeBodyHash returns the sha256 of the canonical body of the message read from r.
+func computeBodyHash(r io.ReadSeeker, relaxed bool, limit int64) ([]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	_, body, err := readRawHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if err := canonicalizeBody(h, body, relaxed, limit); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// computeHeaderHash returns the sha256 of the named header fields, picked from the bottom up,
+// followed by the signature field itself with an empty b= tag, as in RFC 6376 section 3.7.
+func computeHeaderHash(fields, names []string, signature string, relaxed bool) []byte {
+	h := sha256.New()
+
+	used := make(map[int]bool, len(names))
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				io.WriteString(h, canonicalizeHeader(fields[i], relaxed))
+				break
+			}
+		}
+	}
+
+	io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(emptySignatureValue(signature), relaxed), "\r\n"))
+
+	return h.Sum(nil)
+}
+
+// emptySignatureValue returns a signature header field with an empty b= tag, as it was when it was signed.
+func emptySignatureValue(field string) string {
+	i := strings.IndexByte(field, ':')
+
+	return field[:i+1] + signatureValueRe.ReplaceAllString(field[i+1:], "$1$2")
+}
+
+func encodeBase64(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// keyAlgorithm returns the signature algorithm name of an RSA or ed25519 key.
+func keyAlgorithm(key crypto.Signer) (string, crypto.SignerOpts, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", crypto.Hash(0), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %T", key.Public())
+	}
+}
+
+// signHash signs the sha256 hashed data, returning the base64 signature.
+func signHash(key crypto.Signer, hashed []byte) (string, error) {
+	_, opts, err := keyAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := key.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeBase64(sig), nil
+}
+
+// parseCanonicalization parses the c= tag, e.g. relaxed/simple, defaulting to simple/simple.
+func parseCanonicalization(c string) (headerRelaxed, bodyRelaxed bool, err error) {
+	if c == "" {
+		return false, false, nil
+	}
+
+	parts := strings.SplitN(c, "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "simple")
+	}
+
+	for i, part := range parts {
+		switch strings.TrimSpace(part) {
+		case "simple":
+		case "relaxed":
+			if i == 0 {
+				headerRelaxed = true
+			} else {
+				bodyRelaxed = true
+			}
+		default:
+			return false, false, fmt.Errorf("unsupported canonicalization %q", c)
+		}
+	}
+
+	return headerRelaxed, bodyRelaxed, nil
+}
+
+// splitHeaderNames splits a colon separated list, e.g. the h= tag.
+func splitHeaderNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ":") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSubdomain reports whether domain is parent or one of its subdomains.
+func isSubdomain(domain, parent string) bool {
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+// DKIM verifies the DKIM signatures of the message once per transaction, see VerifyDKIM.
+func (c Context) DKIM() ([]DKIMResult, error) {
+	tx := c.session.transaction()
+	if tx.dkim == nil && tx.dkimErr == nil {
+		ctx, cancel := c.session.lookupContext()
+		defer cancel()
+
+		tx.dkim, tx.dkimErr = VerifyDKIM(ctx, c.Body(), c.session.resolver())
+		if tx.dkim == nil && tx.dkimErr == nil {
+			tx.dkim = []DKIMResult{}
+		}
+	}
+
+	return tx.dkim, tx.dkimErr
+}
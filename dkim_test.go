@@ -0,0 +1,166 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testDKIMRecords = &FakeResolver{
+	TXT: map[string][]string{
+		"brisbane._domainkey.example.com": {"v=DKIM1; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQ" +
+			"KBgQDwIRP/UC3SBsEmGqZ9ZJW3/DkMoGeLnQg1fWn7/zYt" +
+			"IxN2SnFCjxOCKG9v3b4jYfcTNh5ijSsq631uBItLa7od+v" +
+			"/RtdC2UzJ1lWT947qR+Rcac2gbto/NMqJ0fzfVjH4OuKhi" +
+			"tdY9tf6mcwGjaNBcWToIMmPSPDdQPNUYckcQ2QIDAQAB"},
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	},
+	Errors: map[string]error{
+		"timeout._domainkey.example.com": &net.DNSError{Err: "i/o timeout", Name: "timeout._domainkey.example.com", IsTimeout: true},
+	},
+}
+
+const testDKIMRSAMessage = `DKIM-Signature: v=1; a=rsa-sha256; s=brisbane; d=example.com;
+      c=simple/simple; q=dns/txt; i=joe@football.example.com;
+      h=Received : From : To : Subject : Date : Message-ID;
+      bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+      b=AuUoFEfDxTDkHlLXSZEpZj79LICEps6eda7W3deTVFOk4yAUoqOB
+      4nujc7YopdG5dWLSdNg6xNAZpOPr+kHxt1IrE+NahM6L/LbvaHut
+      KVdkLLkpVaVVQPzeRDI009SO2Il5Lu7rDNH6mZckBdrIx0orEtZV
+      4bmp/YzhwvcubU4=;
+Received: from client1.football.example.com  [192.0.2.1]
+      by submitserver.example.com with SUBMISSION;
+      Fri, 11 Jul 2003 21:01:54 -0700 (PDT)
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game. Are you hungry yet?
+
+Joe.
+`
+
+// the ed25519 example of RFC 8463 appendix A
+const testDKIMEd25519Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.`
+
+func TestVerifyDKIM(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    DKIMResult
+	}{
+		{
+			name:    "RSA simple/simple",
+			message: testDKIMRSAMessage,
+			want: DKIMResult{
+				Status:     DKIMPass,
+				Domain:     "example.com",
+				Selector:   "brisbane",
+				Identifier: "joe@football.example.com",
+				Algorithm:  "rsa-sha256",
+			},
+		},
+		{
+			name:    "Ed25519 relaxed/relaxed",
+			message: testDKIMEd25519Message,
+			want: DKIMResult{
+				Status:     DKIMPass,
+				Domain:     "football.example.com",
+				Selector:   "brisbane",
+				Identifier: "@football.example.com",
+				Algorithm:  "ed25519-sha256",
+			},
+		},
+		{
+			name:    "Modified body",
+			message: strings.Replace(testDKIMRSAMessage, "Are you hungry", "Are you thirsty", 1),
+			want: DKIMResult{
+				Status:     DKIMFail,
+				Domain:     "example.com",
+				Selector:   "brisbane",
+				Identifier: "joe@football.example.com",
+				Algorithm:  "rsa-sha256",
+				Err:        errors.New("body hash mismatch"),
+			},
+		},
+		{
+			name:    "Modified header",
+			message: strings.Replace(testDKIMEd25519Message, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1),
+			want: DKIMResult{
+				Status:     DKIMFail,
+				Domain:     "football.example.com",
+				Selector:   "brisbane",
+				Identifier: "@football.example.com",
+				Algorithm:  "ed25519-sha256",
+				Err:        errors.New("signature mismatch"),
+			},
+		},
+		{
+			name:    "Unknown selector",
+			message: strings.Replace(testDKIMRSAMessage, "s=brisbane", "s=unknown", 1),
+			want: DKIMResult{
+				Status:     DKIMPermerror,
+				Domain:     "example.com",
+				Selector:   "unknown",
+				Identifier: "joe@football.example.com",
+				Algorithm:  "rsa-sha256",
+				Err:        errors.New("no key for signature"),
+			},
+		},
+		{
+			name:    "Key lookup timeout",
+			message: strings.Replace(testDKIMRSAMessage, "s=brisbane", "s=timeout", 1),
+			want: DKIMResult{
+				Status:     DKIMTemperror,
+				Domain:     "example.com",
+				Selector:   "timeout",
+				Identifier: "joe@football.example.com",
+				Algorithm:  "rsa-sha256",
+				Err:        errors.New("key unavailable: lookup timeout._domainkey.example.com: i/o timeout"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(strings.Replace(tt.message, "\n", "\r\n", -1))
+
+			results, err := VerifyDKIM(context.Background(), r, testDKIMRecords)
+
+			require.NoError(t, err)
+			require.Equal(t, []DKIMResult{tt.want}, results)
+		})
+	}
+}
+
+func TestVerifyDKIMUnsigned(t *testing.T) {
+	results, err := VerifyDKIM(context.Background(), strings.NewReader("From: joe@example.com\r\n\r\nHi.\r\n"), testDKIMRecords)
+
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
@@ -0,0 +1,286 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/zaccone/spf"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARCStatus is the outcome of a DMARC evaluation, as used in Authentication-Results.
+type DMARCStatus string
+
+const (
+	DMARCPass      DMARCStatus = "pass"
+	DMARCFail      DMARCStatus = "fail"
+	DMARCNone      DMARCStatus = "none"
+	DMARCTemperror DMARCStatus = "temperror"
+	DMARCPermerror DMARCStatus = "permerror"
+)
+
+// DMARCPolicy is the requested handling of messages failing DMARC.
+type DMARCPolicy string
+
+const (
+	DMARCPolicyNone       DMARCPolicy = "none"
+	DMARCPolicyQuarantine DMARCPolicy = "quarantine"
+	DMARCPolicyReject     DMARCPolicy = "reject"
+)
+
+// DMARCResult is the DMARC evaluation of the From header domain.
+type DMARCResult struct {
+	Status DMARCStatus
+
+	// Domain is the From header domain, Policy the policy applying to it (p= or sp=).
+	Domain  string
+	Policy  DMARCPolicy
+	Percent int
+
+	// ReportURIs and FailureReportURIs are the rua= and ruf= addresses.
+	ReportURIs        []string
+	FailureReportURIs []string
+
+	SPFAligned  bool
+	DKIMAligned bool
+
+	// Err is the reason of a temperror or permerror.
+	Err error
+}
+
+// ErrDMARCReject is replied by DMARCMiddleware for messages failing a reject policy.
+var ErrDMARCReject = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Unauthenticated email is not accepted due to the sender domain's DMARC policy",
+}
+
+// dmarcRecord is a parsed _dmarc TXT record, as in RFC 7489 section 6.3.
+type dmarcRecord struct {
+	policy          DMARCPolicy
+	subdomainPolicy DMARCPolicy
+	strictDKIM      bool
+	strictSPF       bool
+	percent         int
+	rua             []string
+	ruf             []string
+}
+
+// lookupDMARC fetches the record of domain, falling back to its organizational domain.
+// It returns a nil record when none valid is published, errors are only DNS failures.
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, bool, error) {
+	record, err := lookupDMARCRecord(ctx, resolver, domain)
+	if record != nil || err != nil {
+		return record, false, err
+	}
+
+	orgDomain := organizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, false, nil
+	}
+
+	record, err = lookupDMARCRecord(ctx, resolver, orgDomain)
+
+	return record, true, err
+}
+
+func lookupDMARCRecord(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// only a single DMARC record is allowed, others are ignored
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+
+	if len(records) != 1 {
+		return nil, nil
+	}
+
+	record, err := parseDMARCRecord(records[0])
+	if err != nil {
+		// an invalid record is ignored like a missing one, see RFC 7489 section 6.6.3
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+func parseDMARCRecord(txt string) (*dmarcRecord, error) {
+	tags, err := parseTagList(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &dmarcRecord{percent: 100}
+
+	switch p := DMARCPolicy(strings.ToLower(tags["p"])); p {
+	case DMARCPolicyNone, DMARCPolicyQuarantine, DMARCPolicyReject:
+		record.policy = p
+	default:
+		return nil, fmt.Errorf("dmarc: invalid policy %q", tags["p"])
+	}
+
+	record.subdomainPolicy = record.policy
+	if sp, ok := tags["sp"]; ok {
+		switch sp := DMARCPolicy(strings.ToLower(sp)); sp {
+		case DMARCPolicyNone, DMARCPolicyQuarantine, DMARCPolicyReject:
+			record.subdomainPolicy = sp
+		}
+	}
+
+	record.strictDKIM = strings.ToLower(tags["adkim"]) == "s"
+	record.strictSPF = strings.ToLower(tags["aspf"]) == "s"
+
+	if pct, ok := tags["pct"]; ok {
+		if record.percent, err = strconv.Atoi(pct); err != nil || record.percent < 0 || record.percent > 100 {
+			return nil, fmt.Errorf("dmarc: invalid pct %q", pct)
+		}
+	}
+
+	record.rua = splitURIs(tags["rua"])
+	record.ruf = splitURIs(tags["ruf"])
+
+	return record, nil
+}
+
+func splitURIs(s string) []string {
+	var uris []string
+	for _, uri := range strings.Split(s, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris
+}
+
+// organizationalDomain returns the registered domain of domain according to the public suffix list.
+func organizationalDomain(domain string) string {
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return orgDomain
+}
+
+// aligned reports whether the authenticated domain is aligned with the From domain.
+func aligned(domain, fromDomain string, strict bool) bool {
+	domain, fromDomain = strings.ToLower(domain), strings.ToLower(fromDomain)
+	if strict {
+		return domain == fromDomain
+	}
+
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// DMARC evaluates the DMARC policy of the From header domain once per transaction,
+// using the SPF and DKIM results of the Context. The error is only about reading the message.
+func (c Context) DMARC() (*DMARCResult, error) {
+	tx := c.session.transaction()
+	if tx.dmarc != nil {
+		return tx.dmarc, nil
+	}
+
+	header, err := c.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	dkimResults, err := c.DKIM()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DMARCResult{Status: DMARCNone}
+	tx.dmarc = result
+
+	if len(header.From) != 1 {
+		result.Status, result.Err = DMARCPermerror, errors.New("dmarc: the message must have a single From address")
+		return result, nil
+	}
+
+	_, result.Domain, _ = SplitAddress(header.From[0].Address)
+	result.Domain = strings.ToLower(result.Domain)
+
+	ctx, cancel := c.session.lookupContext()
+	defer cancel()
+
+	record, inherited, err := lookupDMARC(ctx, c.session.resolver(), result.Domain)
+	if err != nil {
+		result.Status, result.Err = DMARCTemperror, err
+		return result, nil
+	} else if record == nil {
+		return result, nil
+	}
+
+	result.Policy = record.policy
+	if inherited {
+		result.Policy = record.subdomainPolicy
+	}
+	result.Percent = record.percent
+	result.ReportURIs = record.rua
+	result.FailureReportURIs = record.ruf
+
+	if check := c.spf(); check.result == spf.Pass {
+		result.SPFAligned = aligned(check.domain, result.Domain, record.strictSPF)
+	}
+
+	for _, dkim := range dkimResults {
+		if dkim.Status == DKIMPass && aligned(dkim.Domain, result.Domain, record.strictDKIM) {
+			result.DKIMAligned = true
+		}
+	}
+
+	result.Status = DMARCFail
+	if result.SPFAligned || result.DKIMAligned {
+		result.Status = DMARCPass
+	}
+
+	return result, nil
+}
+
+// DMARCMiddleware enforces the DMARC policy of failing messages, sampled by their pct=.
+// Rejected messages get a 550, quarantined ones are passed on with MetaQuarantine set in TxMeta.
+func DMARCMiddleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		result, err := c.DMARC()
+		if err != nil || result.Status != DMARCFail {
+			return next(c)
+		}
+
+		policy := result.Policy
+
+		// messages out of the pct= sample get the next weaker policy, as in RFC 7489 section 6.6.4
+		if rand.Intn(100) >= result.Percent {
+			switch policy {
+			case DMARCPolicyReject:
+				policy = DMARCPolicyQuarantine
+			case DMARCPolicyQuarantine:
+				policy = DMARCPolicyNone
+			}
+		}
+
+		switch policy {
+		case DMARCPolicyReject:
+			return ErrDMARCReject
+		case DMARCPolicyQuarantine:
+			c.TxMeta().Set(MetaQuarantine, "dmarc")
+		}
+
+		return next(c)
+	}
+}
@@ -0,0 +1,135 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestContext returns the Context of a transaction which received message.
+func newTestContext(t *testing.T, cfg *ServerConfig, message string) *Context {
+	t.Helper()
+
+	s := NewSession(nil, nil)
+	s.config = cfg
+
+	tx := s.transaction()
+	tx.body = newSpool("", 0)
+	_, err := tx.body.Write([]byte(strings.Replace(message, "\n", "\r\n", -1)))
+	require.NoError(t, err)
+
+	return &Context{session: s}
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	record, err := parseDMARCRecord("v=DMARC1; p=reject; sp=quarantine; adkim=s; pct=20; rua=mailto:a@example.com, mailto:b@example.com")
+
+	require.NoError(t, err)
+	require.Equal(t, &dmarcRecord{
+		policy:          DMARCPolicyReject,
+		subdomainPolicy: DMARCPolicyQuarantine,
+		strictDKIM:      true,
+		percent:         20,
+		rua:             []string{"mailto:a@example.com", "mailto:b@example.com"},
+	}, record)
+
+	_, err = parseDMARCRecord("v=DMARC1; p=bounce")
+	require.Error(t, err)
+}
+
+func TestContextDMARC(t *testing.T) {
+	records := &FakeResolver{TXT: map[string][]string{
+		"_dmarc.example.com":         {"v=DMARC1; p=reject; sp=quarantine; pct=100; rua=mailto:dmarc@example.com"},
+		"_dmarc.invalid.example.com": {"v=DMARC1; p=bounce"},
+		"_dmarc.example.net":         {"v=DMARC1; p=reject; pct=200"},
+	}}
+	for name, txts := range testDKIMRecords.TXT {
+		records.TXT[name] = txts
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		want    *DMARCResult
+	}{
+		{
+			name:    "Aligned DKIM signature of the organizational domain",
+			message: testDKIMEd25519Message,
+			want: &DMARCResult{
+				Status:      DMARCPass,
+				Domain:      "football.example.com",
+				Policy:      DMARCPolicyQuarantine,
+				Percent:     100,
+				ReportURIs:  []string{"mailto:dmarc@example.com"},
+				DKIMAligned: true,
+			},
+		},
+		{
+			name:    "Strict alignment",
+			message: strings.Replace(testDKIMEd25519Message, "From: Joe SixPack <joe@football.example.com>", "From: Joe <joe@example.com>", 1),
+			want: &DMARCResult{
+				Status:     DMARCFail,
+				Domain:     "example.com",
+				Policy:     DMARCPolicyReject,
+				Percent:    100,
+				ReportURIs: []string{"mailto:dmarc@example.com"},
+			},
+		},
+		{
+			name:    "Invalid record ignored for the organizational domain",
+			message: strings.Replace(testDKIMEd25519Message, "From: Joe SixPack <joe@football.example.com>", "From: Joe <joe@invalid.example.com>", 1),
+			want: &DMARCResult{
+				Status:     DMARCFail,
+				Domain:     "invalid.example.com",
+				Policy:     DMARCPolicyQuarantine,
+				Percent:    100,
+				ReportURIs: []string{"mailto:dmarc@example.com"},
+			},
+		},
+		{
+			name:    "Invalid record",
+			message: "From: joe@example.net\n\nHi.\n",
+			want: &DMARCResult{
+				Status: DMARCNone,
+				Domain: "example.net",
+			},
+		},
+		{
+			name:    "No record",
+			message: "From: joe@example.org\n\nHi.\n",
+			want: &DMARCResult{
+				Status: DMARCNone,
+				Domain: "example.org",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, &ServerConfig{Resolver: records}, tt.message)
+
+			result, err := c.DMARC()
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, result)
+		})
+	}
+}
+
+func TestDMARCMiddleware(t *testing.T) {
+	records := &FakeResolver{TXT: map[string][]string{"_dmarc.example.org": {"v=DMARC1; p=quarantine"}}}
+	c := newTestContext(t, &ServerConfig{Resolver: records}, "From: joe@example.org\n\nHi.\n")
+
+	err := DMARCMiddleware(func(c *Context) error { return nil })(c)
+
+	require.NoError(t, err)
+	require.Equal(t, "dmarc", c.TxMeta().GetString(MetaQuarantine))
+
+	records.TXT["_dmarc.example.org"] = []string{"v=DMARC1; p=reject"}
+	c = newTestContext(t, &ServerConfig{Resolver: records}, "From: joe@example.org\n\nHi.\n")
+
+	err = DMARCMiddleware(func(c *Context) error { return nil })(c)
+
+	require.Equal(t, ErrDMARCReject, err)
+}
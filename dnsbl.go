@@ -0,0 +1,281 @@
+package smtpsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DNSBL is a blocklist zone, e.g. zen.spamhaus.org.
+type DNSBL struct {
+	Zone string
+	// Domain zones (RHSBL) list the sender domain instead of the client IP.
+	Domain bool
+	// Codes maps the listing addresses to their meaning, e.g. "127.0.0.2": "spam source".
+	// Addresses missing from a non empty Codes are ignored, otherwise any 127.0.0.0/8 address lists.
+	Codes map[string]string
+	// Weight is added to the score of a listed client, zero counts as 1.
+	Weight float64
+}
+
+// DNSBLListing is a blocklist entry of the client IP or the sender domain.
+type DNSBLListing struct {
+	Zone string
+	// Query is the listed IP address or domain.
+	Query string
+	// Code is the returned address and Reason its meaning from the DNSBL Codes.
+	Code   string
+	Reason string
+	// Text is the TXT record of the listing, often a URL to look it up.
+	Text   string
+	Weight float64
+}
+
+// DNSBLResult holds the listings of the client or sender, Err the last lookup failure.
+type DNSBLResult struct {
+	Listings []DNSBLListing
+	Score    float64
+	// Listed is set when Score reaches the DNSBLChecker Threshold.
+	Listed bool
+	Err    error
+
+	threshold float64
+}
+
+// Reject returns a 554 5.7.1 citing the first listing when Listed, nil otherwise.
+func (r *DNSBLResult) Reject() error {
+	if r == nil || !r.Listed {
+		return nil
+	}
+
+	listing := r.Listings[0]
+	msg := fmt.Sprintf("Service unavailable; %s blocked using %s", listing.Query, listing.Zone)
+	if listing.Text != "" {
+		msg += "; " + listing.Text
+	} else if listing.Reason != "" {
+		msg += "; " + listing.Reason
+	}
+
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      msg,
+	}
+}
+
+// merge adds the listings of other, a client may reach the threshold with both.
+func (r *DNSBLResult) merge(other *DNSBLResult) *DNSBLResult {
+	if other == nil {
+		return r
+	}
+
+	if r == nil {
+		return other
+	}
+
+	merged := &DNSBLResult{
+		Listings:  append(append([]DNSBLListing{}, r.Listings...), other.Listings...),
+		Score:     r.Score + other.Score,
+		Err:       r.Err,
+		threshold: r.threshold,
+	}
+	if other.Err != nil {
+		merged.Err = other.Err
+	}
+
+	merged.Listed = r.Listed || other.Listed || len(merged.Listings) > 0 && merged.Score >= merged.threshold
+
+	return merged
+}
+
+// DNSBLChecker looks up the client IP and the sender domain in blocklists.
+// Set it as ServerConfig.DNSBL to check clients on connect, and add its MailPolicy
+// to check sender domains, the results are on Context.DNSBL.
+type DNSBLChecker struct {
+	Zones []DNSBL
+	// Allowlist holds IP addresses, CIDR networks and domains (with their subdomains) never checked.
+	Allowlist []string
+	// Threshold is the score from which a client is Listed, zero counts as 1.
+	Threshold float64
+	// Reject makes the checks reject listed clients with a 554 5.7.1, otherwise the handler decides.
+	Reject bool
+}
+
+// CheckIP looks up ip in the IP zones, IPv4 as reversed octets and IPv6 as reversed nibbles.
+func (d *DNSBLChecker) CheckIP(ctx context.Context, resolver Resolver, ip net.IP) *DNSBLResult {
+	result := &DNSBLResult{threshold: d.threshold()}
+	if ip == nil || allowedIP(d.Allowlist, ip) {
+		return result
+	}
+
+	prefix := reverseIP(ip)
+	for _, zone := range d.Zones {
+		if !zone.Domain {
+			d.lookup(ctx, resolver, zone, ip.String(), prefix, result)
+		}
+	}
+
+	return result
+}
+
+// CheckDomain looks up domain in the domain zones.
+func (d *DNSBLChecker) CheckDomain(ctx context.Context, resolver Resolver, domain string) *DNSBLResult {
+	result := &DNSBLResult{threshold: d.threshold()}
+
+	domain = normalizeName(domain)
+	if domain == "" || allowedDomain(d.Allowlist, domain) {
+		return result
+	}
+
+	for _, zone := range d.Zones {
+		if zone.Domain {
+			d.lookup(ctx, resolver, zone, domain, domain, result)
+		}
+	}
+
+	return result
+}
+
+// MailPolicy checks the sender domain, and the client IP unless checked on connect.
+func (d *DNSBLChecker) MailPolicy(c *Context, from *mail.Address) error {
+	s := c.session
+
+	ctx, cancel := s.lookupContext()
+	defer cancel()
+
+	if s.dnsbl == nil {
+		s.dnsbl = d.CheckIP(ctx, s.resolver(), c.RemoteIP())
+	}
+
+	if _, domain, err := SplitAddress(from.Address); err == nil {
+		s.transaction().dnsbl = d.CheckDomain(ctx, s.resolver(), domain)
+	}
+
+	if d.Reject {
+		return c.DNSBL().Reject()
+	}
+
+	return nil
+}
+
+func (d *DNSBLChecker) lookup(ctx context.Context, resolver Resolver, zone DNSBL, query, prefix string, result *DNSBLResult) {
+	name := prefix + "." + strings.TrimSuffix(zone.Zone, ".")
+
+	addrs, err := resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		if !isNotFound(err) {
+			result.Err = err
+		}
+
+		return
+	}
+
+	for _, addr := range addrs {
+		code := addr.IP.String()
+
+		reason, ok := zone.Codes[code]
+		if !ok && isDNSBLError(addr.IP) {
+			result.Err = fmt.Errorf("dnsbl: %s answered %s to %s", zone.Zone, code, query)
+			return
+		}
+
+		if len(zone.Codes) > 0 && !ok || len(zone.Codes) == 0 && !isLoopback(addr.IP) {
+			continue
+		}
+
+		weight := zone.Weight
+		if weight == 0 {
+			weight = 1
+		}
+
+		listing := DNSBLListing{Zone: zone.Zone, Query: query, Code: code, Reason: reason, Weight: weight}
+		if txts, err := resolver.LookupTXT(ctx, name); err == nil {
+			listing.Text = strings.Join(txts, " ")
+		}
+
+		result.Listings = append(result.Listings, listing)
+		result.Score += weight
+		result.Listed = result.Score >= result.threshold
+
+		// a zone counts once, whatever its codes
+		return
+	}
+}
+
+func (d *DNSBLChecker) threshold() float64 {
+	if d.Threshold == 0 {
+		return 1
+	}
+
+	return d.Threshold
+}
+
+// allowedIP reports whether ip is, or is in a network, of the allowlist.
+func allowedIP(allowlist []string, ip net.IP) bool {
+	for _, entry := range allowlist {
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedDomain reports whether domain is, or is a subdomain of, a domain of the allowlist.
+func allowedDomain(allowlist []string, domain string) bool {
+	for _, entry := range allowlist {
+		if isSubdomain(domain, normalizeName(entry)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLoopback reports whether ip is in 127.0.0.0/8, where blocklists answer.
+func isLoopback(ip net.IP) bool {
+	ip4 := ip.To4()
+
+	return ip4 != nil && ip4[0] == 127
+}
+
+// isDNSBLError reports whether ip is an error answer rather than a listing: 127.0.0.1, or in 127.255.255.0/24
+// as Spamhaus answers queries through public resolvers or over the quota.
+func isDNSBLError(ip net.IP) bool {
+	ip4 := ip.To4()
+
+	return ip4 != nil && (ip4.Equal(net.IPv4(127, 0, 0, 1)) || ip4[0] == 127 && ip4[1] == 255 && ip4[2] == 255)
+}
+
+// reverseIP returns the DNSBL query prefix of ip, e.g. 2.0.0.127 or the 32 nibbles of an IPv6 address.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip16 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0xf), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+// DNSBL returns the listings of the client IP and of the sender domain, nil when not checked.
+func (c Context) DNSBL() *DNSBLResult {
+	var domain *DNSBLResult
+	if c.session.tx != nil {
+		domain = c.session.tx.dnsbl
+	}
+
+	return c.session.dnsbl.merge(domain)
+}
@@ -0,0 +1,144 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testDNSBLRecords = &FakeResolver{
+	IP: map[string][]net.IP{
+		"2.2.0.192.zen.example.org":        {net.ParseIP("127.0.0.2")},
+		"3.2.0.192.zen.example.org":        {net.ParseIP("127.0.0.10")},
+		"2.2.0.192.bl.example.net":         {net.ParseIP("127.0.0.2")},
+		"5.2.0.192.bl.example.net":         {net.ParseIP("127.255.255.254")},
+		"6.2.0.192.bl.example.net":         {net.ParseIP("127.0.0.1")},
+		"5.2.0.192.zen.example.org":        {net.ParseIP("127.255.255.252")},
+		"1.0.0.127.zen.example.org":        {net.ParseIP("127.0.0.4")},
+		"spam.example.com.dbl.example.org": {net.ParseIP("127.0.1.2")},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.org": {net.ParseIP("127.0.0.3")},
+	},
+	TXT: map[string][]string{
+		"2.2.0.192.zen.example.org": {"https://zen.example.org/query/ip/192.0.2.2"},
+	},
+	Errors: map[string]error{
+		"4.2.0.192.zen.example.org": &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+	},
+}
+
+var testDNSBLChecker = &DNSBLChecker{
+	Zones: []DNSBL{
+		{Zone: "zen.example.org", Codes: map[string]string{"127.0.0.2": "spam source", "127.0.0.3": "exploits", "127.0.0.4": "exploits"}},
+		{Zone: "bl.example.net", Weight: 0.5},
+		{Zone: "dbl.example.org", Domain: true, Weight: 2},
+	},
+	Allowlist: []string{"192.0.2.128/25", "partner.example.com"},
+	Threshold: 1.5,
+}
+
+func TestReverseIP(t *testing.T) {
+	require.Equal(t, "2.2.0.192", reverseIP(net.ParseIP("192.0.2.2")))
+	require.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2", reverseIP(net.ParseIP("2001:db8::1")))
+}
+
+func TestDNSBLCheckIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		score  float64
+		listed bool
+		err    bool
+	}{
+		{ip: "192.0.2.2", score: 1.5, listed: true},
+		{ip: "2001:db8::1", score: 1},
+		// not a known code
+		{ip: "192.0.2.3"},
+		{ip: "192.0.2.4", err: true},
+		// error answers aren't listings
+		{ip: "192.0.2.5", err: true},
+		{ip: "192.0.2.6", err: true},
+		{ip: "192.0.2.200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			result := testDNSBLChecker.CheckIP(context.Background(), testDNSBLRecords, net.ParseIP(tt.ip))
+
+			require.Equal(t, tt.score, result.Score)
+			require.Equal(t, tt.listed, result.Listed)
+			require.Equal(t, tt.err, result.Err != nil)
+		})
+	}
+
+	result := testDNSBLChecker.CheckIP(context.Background(), testDNSBLRecords, net.ParseIP("192.0.2.2"))
+	require.Equal(t, DNSBLListing{
+		Zone:   "zen.example.org",
+		Query:  "192.0.2.2",
+		Code:   "127.0.0.2",
+		Reason: "spam source",
+		Text:   "https://zen.example.org/query/ip/192.0.2.2",
+		Weight: 1,
+	}, result.Listings[0])
+	require.EqualError(t, result.Reject(), "SMTP error 554: Service unavailable; 192.0.2.2 blocked using zen.example.org; https://zen.example.org/query/ip/192.0.2.2")
+}
+
+func TestDNSBLMailPolicy(t *testing.T) {
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{Resolver: testDNSBLRecords}
+	c := &Context{session: s}
+
+	// the IP alone doesn't reach the threshold, with the domain it does
+	s.dnsbl = testDNSBLChecker.CheckIP(context.Background(), testDNSBLRecords, net.ParseIP("2001:db8::1"))
+	require.False(t, c.DNSBL().Listed)
+
+	require.NoError(t, testDNSBLChecker.MailPolicy(c, &mail.Address{Address: "sender@spam.example.com"}))
+	require.True(t, c.DNSBL().Listed)
+	require.Equal(t, 3.0, c.DNSBL().Score)
+	require.Len(t, c.DNSBL().Listings, 2)
+
+	s.Reset()
+	require.False(t, c.DNSBL().Listed)
+
+	rejecting := *testDNSBLChecker
+	rejecting.Reject = true
+	require.Error(t, rejecting.MailPolicy(c, &mail.Address{Address: "sender@spam.example.com"}))
+	require.NoError(t, rejecting.MailPolicy(c, &mail.Address{Address: "sender@partner.example.com"}))
+}
+
+func TestDNSBLOnConnect(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		Resolver: testDNSBLRecords,
+		DNSBL:    &DNSBLChecker{Zones: testDNSBLChecker.Zones, Reject: true},
+	})
+
+	_, code, msg := dialTestServer(t, addr)
+	require.Equal(t, 554, code)
+	require.Equal(t, "5.7.1 Service unavailable; 127.0.0.1 blocked using zen.example.org; exploits", msg)
+
+	listed := make(chan bool, 1)
+	addr = startTestServer(t, &ServerConfig{
+		Resolver: testDNSBLRecords,
+		DNSBL:    &DNSBLChecker{Zones: testDNSBLChecker.Zones},
+		Handler: func(c *Context) error {
+			listed <- c.DNSBL().Listed
+			return c.DNSBL().Reject()
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+	code, _ = command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 554, code)
+	require.True(t, <-listed)
+}
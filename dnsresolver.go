@@ -0,0 +1,333 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultNegativeTTL caches missing records when the response has no SOA to take it from.
+const DefaultNegativeTTL = time.Minute
+
+// DefaultDNSCacheSize caps the cached answers when DNSResolver.CacheSize is zero.
+const DefaultDNSCacheSize = 10000
+
+// dnsCacheSweep is how often the expired answers are dropped from the cache.
+const dnsCacheSweep = time.Minute
+
+var errNoNameservers = errors.New("dns: no nameservers")
+
+// DNSResolver queries nameservers directly and caches the answers for their TTL,
+// and missing records for the SOA minimum as in RFC 2308. Failures aren't cached.
+type DNSResolver struct {
+	// Servers are queried in order until one answers, as host:port.
+	Servers []string
+	// Timeout bounds each query, the context may end it earlier.
+	Timeout time.Duration
+	// MaxTTL caps the time answers are cached, zero means the TTL of the records.
+	MaxTTL time.Duration
+	// CacheSize caps the cached answers, it defaults to DefaultDNSCacheSize.
+	CacheSize int
+
+	mu        sync.Mutex
+	cache     map[dnsQuestion]*dnsAnswer
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsAnswer struct {
+	records []dns.RR
+	err     error
+	expires time.Time
+}
+
+// NewDNSResolver queries servers, or the nameservers of /etc/resolv.conf when none is given.
+func NewDNSResolver(servers ...string) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, server := range config.Servers {
+			servers = append(servers, net.JoinHostPort(server, config.Port))
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, errNoNameservers
+	}
+
+	return &DNSResolver{
+		Servers: servers,
+		Timeout: 5 * time.Second,
+		cache:   map[dnsQuestion]*dnsAnswer{},
+		now:     time.Now,
+	}, nil
+}
+
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.query(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, 0, len(records))
+	for _, rr := range records {
+		txts = append(txts, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+
+	return txts, nil
+}
+
+func (r *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := r.query(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	mxs := make([]*net.MX, 0, len(records))
+	for _, rr := range records {
+		mx := rr.(*dns.MX)
+		mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+
+	return mxs, nil
+}
+
+// LookupIPAddr returns both the A and AAAA records, the host is only missing when both are.
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	var addrs []net.IPAddr
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		records, err := r.query(ctx, host, qtype)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, err
+			}
+
+			lastErr = err
+			continue
+		}
+
+		for _, rr := range records {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: rr.A})
+			case *dns.AAAA:
+				addrs = append(addrs, net.IPAddr{IP: rr.AAAA})
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, lastErr
+	}
+
+	return addrs, nil
+}
+
+// LookupAddr returns the PTR names of an IP address.
+func (r *DNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+
+	records, err := r.query(ctx, name, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(records))
+	for _, rr := range records {
+		names = append(names, rr.(*dns.PTR).Ptr)
+	}
+
+	return names, nil
+}
+
+func (r *DNSResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	records, err := r.query(ctx, name, dns.TypeTLSA)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsas := make([]TLSA, 0, len(records))
+	for _, rr := range records {
+		tlsa := rr.(*dns.TLSA)
+		tlsas = append(tlsas, TLSA{
+			Usage:        tlsa.Usage,
+			Selector:     tlsa.Selector,
+			MatchingType: tlsa.MatchingType,
+			Certificate:  tlsa.Certificate,
+		})
+	}
+
+	return tlsas, nil
+}
+
+// query returns the records of qtype for name, from the cache while they live.
+func (r *DNSResolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	question := dnsQuestion{name: dns.Fqdn(strings.ToLower(name)), qtype: qtype}
+
+	r.mu.Lock()
+	answer, ok := r.cache[question]
+	r.mu.Unlock()
+
+	if ok && r.clock().Before(answer.expires) {
+		return answer.records, answer.err
+	}
+
+	answer, err := r.exchange(ctx, question)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = map[dnsQuestion]*dnsAnswer{}
+	}
+	r.evict()
+	r.cache[question] = answer
+	r.mu.Unlock()
+
+	return answer.records, answer.err
+}
+
+// exchange asks the servers in turn, only errors to cache are set on the answer.
+func (r *DNSResolver) exchange(ctx context.Context, question dnsQuestion) (*dnsAnswer, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(question.name, question.qtype)
+	m.SetEdns0(4096, false)
+
+	client := &dns.Client{Timeout: r.Timeout}
+	tcpClient := &dns.Client{Net: "tcp", Timeout: r.Timeout}
+
+	var in *dns.Msg
+	err := errNoNameservers
+	for _, server := range r.Servers {
+		in, _, err = client.ExchangeContext(ctx, m, server)
+		if err == nil && in.Truncated {
+			// the answer doesn't fit in UDP
+			in, _, err = tcpClient.ExchangeContext(ctx, m, server)
+		}
+
+		if err == nil && in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			err = errors.New("server misbehaving")
+		}
+
+		if err == nil {
+			break
+		}
+	}
+
+	name := strings.TrimSuffix(question.name, ".")
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() || ctx.Err() == context.DeadlineExceeded {
+			dnsErr.IsTimeout = true
+		}
+
+		return nil, dnsErr
+	}
+
+	answer := &dnsAnswer{}
+
+	var ttl uint32
+	for _, rr := range in.Answer {
+		if rr.Header().Rrtype != question.qtype {
+			// CNAMEs along the way
+			continue
+		}
+
+		if len(answer.records) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+
+		answer.records = append(answer.records, rr)
+	}
+
+	expiry := time.Duration(ttl) * time.Second
+	if len(answer.records) == 0 {
+		answer.err = errNotFound(name)
+		expiry = negativeTTL(in)
+	}
+
+	if r.MaxTTL > 0 && expiry > r.MaxTTL {
+		expiry = r.MaxTTL
+	}
+
+	answer.expires = r.clock().Add(expiry)
+
+	return answer, nil
+}
+
+// evict drops the expired answers every dnsCacheSweep, and any answers to make room for a new one
+// when the cache is full. r.mu must be held.
+func (r *DNSResolver) evict() {
+	size := r.CacheSize
+	if size <= 0 {
+		size = DefaultDNSCacheSize
+	}
+
+	now := r.clock()
+	if now.Sub(r.lastSweep) >= dnsCacheSweep || len(r.cache) >= size {
+		r.lastSweep = now
+		for question, answer := range r.cache {
+			if !now.Before(answer.expires) {
+				delete(r.cache, question)
+			}
+		}
+	}
+
+	// map iteration order is random enough to pick the answers to drop
+	for question := range r.cache {
+		if len(r.cache) < size {
+			break
+		}
+
+		delete(r.cache, question)
+	}
+}
+
+func (r *DNSResolver) clock() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+
+	return r.now()
+}
+
+// negativeTTL is the lesser of the SOA minimum and its own TTL, as in RFC 2308 section 5.
+func negativeTTL(m *dns.Msg) time.Duration {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+
+			return time.Duration(ttl) * time.Second
+		}
+	}
+
+	return DefaultNegativeTTL
+}
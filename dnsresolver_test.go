@@ -0,0 +1,219 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestDNS serves a few records of example.org over UDP and TCP and counts the queries.
+func startTestDNS(t *testing.T) (string, *int32) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var queries int32
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		q := req.Question[0]
+		switch {
+		case q.Name == "example.org." && q.Qtype == dns.TypeMX:
+			m.Answer = append(m.Answer,
+				&dns.MX{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 300}, Preference: 20, Mx: "mx2.example.org."},
+				&dns.MX{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60}, Preference: 10, Mx: "mx1.example.org."})
+		case q.Name == "example.org." && q.Qtype == dns.TypeTXT:
+			m.Answer = append(m.Answer,
+				&dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{"v=spf1 ", "-all"}})
+		case q.Name == "mx1.example.org." && q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer,
+				&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+		case q.Name == "1.2.0.192.in-addr.arpa." && q.Qtype == dns.TypePTR:
+			m.Answer = append(m.Answer,
+				&dns.PTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60}, Ptr: "mx1.example.org."})
+		case q.Name == "_25._tcp.mx1.example.org." && q.Qtype == dns.TypeTLSA:
+			m.Answer = append(m.Answer,
+				&dns.TLSA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: 60}, Usage: 3, Selector: 1, MatchingType: 1, Certificate: "abcd"})
+		case q.Name == "large.example.org." && q.Qtype == dns.TypeTXT:
+			// only over TCP
+			if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+				m.Truncated = true
+				break
+			}
+
+			for i := 0; i < 3; i++ {
+				m.Answer = append(m.Answer,
+					&dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{"large"}})
+			}
+		case q.Name == "fail.example.org.":
+			m.Rcode = dns.RcodeServerFailure
+		case q.Name == "mx1.example.org.":
+			// no AAAA
+			m.Ns = append(m.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600}, Ns: "ns.example.org.", Mbox: "hostmaster.example.org.", Minttl: 30})
+		default:
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600}, Ns: "ns.example.org.", Mbox: "hostmaster.example.org.", Minttl: 30})
+		}
+
+		w.WriteMsg(m)
+	})
+
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	require.NoError(t, err)
+
+	tcpServer := &dns.Server{Listener: l, Handler: mux}
+	go tcpServer.ActivateAndServe()
+	t.Cleanup(func() { tcpServer.Shutdown() })
+
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestDNSResolver(t *testing.T) {
+	addr, _ := startTestDNS(t)
+
+	r, err := NewDNSResolver(addr)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	mxs, err := r.LookupMX(ctx, "example.org")
+	require.NoError(t, err)
+	require.Equal(t, []*net.MX{{Host: "mx1.example.org.", Pref: 10}, {Host: "mx2.example.org.", Pref: 20}}, mxs)
+
+	txts, err := r.LookupTXT(ctx, "example.org")
+	require.NoError(t, err)
+	require.Equal(t, []string{"v=spf1 -all"}, txts)
+
+	addrs, err := r.LookupIPAddr(ctx, "mx1.example.org")
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	require.True(t, addrs[0].IP.Equal(net.ParseIP("192.0.2.1")))
+
+	names, err := r.LookupAddr(ctx, "192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"mx1.example.org."}, names)
+
+	tlsas, err := r.LookupTLSA(ctx, "_25._tcp.mx1.example.org")
+	require.NoError(t, err)
+	require.Equal(t, []TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "abcd"}}, tlsas)
+
+	_, err = r.LookupIPAddr(ctx, "missing.example.org")
+	require.True(t, isNotFound(err))
+
+	_, err = r.LookupTXT(ctx, "fail.example.org")
+	require.Error(t, err)
+	require.False(t, isNotFound(err))
+}
+
+func TestDNSResolverTruncated(t *testing.T) {
+	addr, queries := startTestDNS(t)
+
+	r, err := NewDNSResolver(addr)
+	require.NoError(t, err)
+
+	txts, err := r.LookupTXT(context.Background(), "large.example.org")
+	require.NoError(t, err)
+	require.Equal(t, []string{"large", "large", "large"}, txts)
+	require.Equal(t, int32(2), atomic.LoadInt32(queries))
+}
+
+func TestDNSResolverNoServers(t *testing.T) {
+	_, err := (&DNSResolver{}).LookupTXT(context.Background(), "example.org")
+	require.EqualError(t, err, "lookup example.org: dns: no nameservers")
+}
+
+func TestDNSResolverCache(t *testing.T) {
+	addr, queries := startTestDNS(t)
+
+	r, err := NewDNSResolver(addr)
+	require.NoError(t, err)
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	lookup := func(name string) {
+		r.LookupMX(ctx, name)
+	}
+
+	// the lowest TTL of the answer applies
+	lookup("example.org")
+	lookup("example.org")
+	require.Equal(t, int32(1), atomic.LoadInt32(queries))
+
+	now = now.Add(61 * time.Second)
+	lookup("example.org")
+	require.Equal(t, int32(2), atomic.LoadInt32(queries))
+
+	// missing names live for the SOA minimum
+	lookup("missing.example.org")
+	lookup("missing.example.org")
+	require.Equal(t, int32(3), atomic.LoadInt32(queries))
+
+	now = now.Add(31 * time.Second)
+	lookup("missing.example.org")
+	require.Equal(t, int32(4), atomic.LoadInt32(queries))
+
+	// failures are asked again
+	lookup("fail.example.org")
+	lookup("fail.example.org")
+	require.Equal(t, int32(6), atomic.LoadInt32(queries))
+}
+
+func TestDNSResolverCacheEviction(t *testing.T) {
+	addr, _ := startTestDNS(t)
+
+	r, err := NewDNSResolver(addr)
+	require.NoError(t, err)
+	r.CacheSize = 3
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	r.LookupMX(ctx, "example.org")
+	r.LookupTXT(ctx, "example.org")
+	require.Len(t, r.cache, 2)
+
+	// expired answers are swept
+	now = now.Add(2 * time.Minute)
+	r.LookupTXT(ctx, "missing.example.org")
+	require.Len(t, r.cache, 1)
+
+	// a full cache makes room
+	for _, name := range []string{"a.example.org", "b.example.org", "c.example.org", "d.example.org"} {
+		r.LookupTXT(ctx, name)
+	}
+	require.Len(t, r.cache, 3)
+}
+
+func TestDNSResolverTimeout(t *testing.T) {
+	// nothing answers on this socket
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	r, err := NewDNSResolver(pc.LocalAddr().String())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = r.LookupTXT(ctx, "example.org")
+	require.Error(t, err)
+	require.True(t, err.(*net.DNSError).IsTimeout)
+}
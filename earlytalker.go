@@ -0,0 +1,125 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	// ErrPregreet is replied instead of the greeting to the clients talking before it, with RejectEarlyTalkers.
+	ErrPregreet = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "Protocol error, talking before the greeting",
+	}
+
+	// ErrIllegalPipelining is replied to the HELO/EHLO of clients pipelining before EHLO, with RejectEarlyTalkers.
+	ErrIllegalPipelining = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "Protocol error, pipelining before EHLO",
+	}
+)
+
+// waitGreeting holds the greeting back for GreetDelay, a client talking meanwhile is a pregreeting early talker.
+// What it sent is kept for the SMTP reader, implicit TLS clients talk first anyway.
+func (c *conn) waitGreeting() error {
+	delay := c.config.GreetDelay
+	if delay <= 0 || c.tls {
+		return nil
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(delay))
+
+	buf := make([]byte, 512)
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.early = buf[:n]
+		c.pregreet = true
+	}
+
+	if err != nil {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return err
+		}
+	}
+
+	// the greeting write deadline expired meanwhile, and the reads are ours again
+	c.Conn.SetReadDeadline(time.Time{})
+	if c.config.WriteTimeout != 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+
+	if c.pregreet {
+		c.config.logger().Printf("pregreet from %v: %q", c.RemoteAddr(), c.early)
+		if c.config.RejectEarlyTalkers {
+			return ErrPregreet
+		}
+	}
+
+	return nil
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.early) > 0 {
+		n := copy(p, c.early)
+		c.early = c.early[n:]
+		c.inspect(p[:n])
+
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(p)
+	c.inspect(p[:n])
+
+	return n, err
+}
+
+// inspect looks for commands sent along another one before the first HELO/EHLO is answered,
+// which is illegal as PIPELINING isn't advertised yet. Implicit TLS reads are still encrypted here.
+func (c *conn) inspect(p []byte) {
+	for !c.greeted && !c.tls && len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			c.keepVerb(p)
+			return
+		}
+
+		c.keepVerb(p[:i])
+		verb := strings.ToUpper(string(c.line))
+		c.line, p = c.line[:0], p[i+1:]
+
+		if len(p) > 0 {
+			c.pipelining = true
+		}
+
+		if verb == "EHLO" || verb == "HELO" {
+			c.greeted = true
+		}
+	}
+}
+
+// keepVerb keeps the first four bytes of the line being read, enough to recognize HELO and EHLO.
+func (c *conn) keepVerb(p []byte) {
+	if n := 4 - len(c.line); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		c.line = append(c.line, p[:n]...)
+	}
+}
+
+// Pregreet returns whether the client talked before the greeting, see ServerConfig.GreetDelay.
+func (c Context) Pregreet() bool {
+	return c.session.pregreet
+}
+
+// IllegalPipelining returns whether the client sent commands along its HELO/EHLO, or before it,
+// without waiting for the replies.
+func (c Context) IllegalPipelining() bool {
+	return c.session.pipelining
+}
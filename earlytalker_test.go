@@ -0,0 +1,155 @@
+package smtpsrv
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// earlyTalker records the early talker checks of the delivered messages.
+type earlyTalker struct {
+	pregreet, pipelining bool
+}
+
+func startEarlyTalkerServer(t *testing.T, delay time.Duration, reject bool) (string, chan earlyTalker) {
+	t.Helper()
+
+	delivered := make(chan earlyTalker, 1)
+	addr := startTestServer(t, &ServerConfig{
+		GreetDelay:         delay,
+		RejectEarlyTalkers: reject,
+		Handler: func(c *Context) error {
+			delivered <- earlyTalker{c.Pregreet(), c.IllegalPipelining()}
+			return nil
+		},
+	})
+
+	return addr, delivered
+}
+
+// dialRaw connects without reading the greeting.
+func dialRaw(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	c := textproto.NewConn(nc)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// writeRaw sends data in a single write.
+func writeRaw(t *testing.T, c *textproto.Conn, data string) {
+	t.Helper()
+
+	_, err := c.W.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, c.W.Flush())
+}
+
+// finishTransaction sends a message once the EHLO reply was read.
+func finishTransaction(t *testing.T, c *textproto.Conn) {
+	t.Helper()
+
+	code, _ := command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+	code, _ = command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+}
+
+func TestPregreet(t *testing.T) {
+	addr, delivered := startEarlyTalkerServer(t, 200*time.Millisecond, false)
+
+	c := dialRaw(t, addr)
+	writeRaw(t, c, "EHLO client.example.org\r\n")
+
+	code, _, err := c.ReadResponse(220)
+	require.NoError(t, err, code)
+	code, _, err = c.ReadResponse(250)
+	require.NoError(t, err, code)
+
+	finishTransaction(t, c)
+	require.Equal(t, earlyTalker{pregreet: true}, <-delivered)
+
+	// a client waiting for the greeting
+	c = dialRaw(t, addr)
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+
+	finishTransaction(t, c)
+	require.Equal(t, earlyTalker{}, <-delivered)
+}
+
+func TestPregreetReject(t *testing.T) {
+	addr, _ := startEarlyTalkerServer(t, 200*time.Millisecond, true)
+
+	c := dialRaw(t, addr)
+	writeRaw(t, c, "EHLO client.example.org\r\n")
+
+	code, msg, _ := c.ReadResponse(0)
+	require.Equal(t, 554, code)
+	require.Equal(t, "5.5.1 Protocol error, talking before the greeting", msg)
+
+	_, err := c.ReadLine()
+	require.Error(t, err)
+}
+
+func TestIllegalPipelining(t *testing.T) {
+	addr, delivered := startEarlyTalkerServer(t, 0, false)
+
+	c := dialRaw(t, addr)
+	_, _, err := c.ReadResponse(220)
+	require.NoError(t, err)
+
+	writeRaw(t, c, "EHLO client.example.org\r\nMAIL FROM:<sender@example.org>\r\nRCPT TO:<recipient@example.com>\r\nDATA\r\n")
+	for _, code := range []int{250, 250, 250, 354} {
+		_, _, err := c.ReadResponse(code)
+		require.NoError(t, err)
+	}
+
+	code, _ := command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+	require.Equal(t, earlyTalker{pipelining: true}, <-delivered)
+
+	// pipelining once EHLO was answered is fine
+	c = dialRaw(t, addr)
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+
+	writeRaw(t, c, "MAIL FROM:<sender@example.org>\r\nRCPT TO:<recipient@example.com>\r\nDATA\r\n")
+	for _, code := range []int{250, 250, 354} {
+		_, _, err := c.ReadResponse(code)
+		require.NoError(t, err)
+	}
+
+	code, _ = command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+	require.Equal(t, earlyTalker{}, <-delivered)
+}
+
+func TestIllegalPipeliningReject(t *testing.T) {
+	addr, _ := startEarlyTalkerServer(t, 0, true)
+
+	c := dialRaw(t, addr)
+	_, _, err := c.ReadResponse(220)
+	require.NoError(t, err)
+
+	writeRaw(t, c, "HELO client.example.org\r\nMAIL FROM:<sender@example.org>\r\n")
+
+	code, msg, _ := c.ReadResponse(0)
+	require.Equal(t, 554, code)
+	require.Equal(t, "5.5.1 Protocol error, pipelining before EHLO", msg)
+}
@@ -1,7 +1,18 @@
 package smtpsrv
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
 
 var (
 	ErrAuthDisabled = errors.New("auth is disabled")
+
+	// ErrHandlerPanic is replied when the handler panics, so the client retries later.
+	ErrHandlerPanic = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Local error in processing, try again later",
+	}
 )
@@ -0,0 +1,467 @@
+package smtpsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrGreylisted is replied to unknown triplets, real MTAs retry later.
+var ErrGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+// Greylisting defaults, as in postgrey.
+const (
+	DefaultGreylistDelay       = 5 * time.Minute
+	DefaultGreylistRetryWindow = 48 * time.Hour
+	DefaultGreylistExpiry      = 35 * 24 * time.Hour
+)
+
+// GreylistEntry is the state of a triplet, or of a client network for auto-allowlisting.
+type GreylistEntry struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Passed is set once the triplet retried after the delay, or the client is allowlisted.
+	Passed bool `json:"passed"`
+	// Count is the number of triplets of a client which passed.
+	Count int `json:"count"`
+}
+
+// GreylistStore keeps the greylisting state, it must be safe for concurrent use.
+type GreylistStore interface {
+	// Get returns the entry of key, or nil when unknown.
+	Get(key string) (*GreylistEntry, error)
+	Put(key string, entry *GreylistEntry) error
+	// Purge removes the entries for which expired returns true.
+	Purge(expired func(entry *GreylistEntry) bool) error
+}
+
+// Greylist temporarily rejects unknown (client network, sender, recipient) triplets, see Policy.
+// Client networks are /24 for IPv4 and /64 for IPv6, as large senders retry from other hosts.
+type Greylist struct {
+	// Store defaults to an in-memory store. Flush a FileGreylistStore on shutdown.
+	Store GreylistStore
+	// Delay is the time before a retry is accepted, it defaults to DefaultGreylistDelay.
+	Delay time.Duration
+	// RetryWindow is the time a triplet has to retry, it defaults to DefaultGreylistRetryWindow.
+	RetryWindow time.Duration
+	// Expiry is the time a passed triplet or client lives without traffic, it defaults to DefaultGreylistExpiry.
+	Expiry time.Duration
+	// AutoAllowlist is the number of passed triplets from which a client network isn't greylisted anymore,
+	// zero disables it.
+	AutoAllowlist int
+	// Allowlist holds client IP addresses, CIDR networks and domains never greylisted.
+	// Domains match the sender domain and the forward-confirmed client hostname.
+	Allowlist []string
+
+	mu        sync.Mutex
+	lastPurge time.Time
+	now       func() time.Time
+	// locks serializes the checks of a client network, which read and then write its entries
+	locks map[string]*greylistLock
+}
+
+type greylistLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Policy greylists the recipients, it is a RcptPolicy.
+func (g *Greylist) Policy(c *Context, to *mail.Address) error {
+	return g.check(c, c.RemoteIP(), to)
+}
+
+func (g *Greylist) check(c *Context, ip net.IP, to *mail.Address) error {
+	if ip == nil || g.allowed(c, ip) {
+		return nil
+	}
+
+	now := g.clock()
+	store := g.store()
+
+	if err := g.purge(now); err != nil {
+		return err
+	}
+
+	network := clientNetwork(ip)
+
+	unlock := g.lock(network)
+	defer unlock()
+
+	client, err := store.Get("client " + network)
+	if err != nil {
+		return err
+	}
+
+	if client != nil && client.Passed && now.Sub(client.LastSeen) < g.expiry() {
+		client.LastSeen = now
+		return store.Put("client "+network, client)
+	}
+
+	var from string
+	if c.From() != nil {
+		from = strings.ToLower(c.From().Address)
+	}
+	key := "triplet " + network + " <" + from + "> <" + strings.ToLower(to.Address) + ">"
+
+	entry, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil || g.expired(entry, now) {
+		if err := store.Put(key, &GreylistEntry{FirstSeen: now, LastSeen: now}); err != nil {
+			return err
+		}
+
+		return ErrGreylisted
+	}
+
+	entry.LastSeen = now
+	if !entry.Passed && now.Sub(entry.FirstSeen) < g.delay() {
+		if err := store.Put(key, entry); err != nil {
+			return err
+		}
+
+		return ErrGreylisted
+	}
+
+	first := !entry.Passed
+	entry.Passed = true
+	if err := store.Put(key, entry); err != nil {
+		return err
+	}
+
+	if first && g.AutoAllowlist > 0 {
+		if client == nil || g.expired(client, now) {
+			client = &GreylistEntry{FirstSeen: now}
+		}
+
+		client.LastSeen = now
+		client.Count++
+		client.Passed = client.Count >= g.AutoAllowlist
+
+		return store.Put("client "+network, client)
+	}
+
+	return nil
+}
+
+// lock locks the entries of a client network, the returned func unlocks them.
+func (g *Greylist) lock(network string) func() {
+	g.mu.Lock()
+	if g.locks == nil {
+		g.locks = map[string]*greylistLock{}
+	}
+
+	l := g.locks[network]
+	if l == nil {
+		l = &greylistLock{}
+		g.locks[network] = l
+	}
+	l.refs++
+	g.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if l.refs--; l.refs == 0 {
+			delete(g.locks, network)
+		}
+	}
+}
+
+func (g *Greylist) allowed(c *Context, ip net.IP) bool {
+	if allowedIP(g.Allowlist, ip) {
+		return true
+	}
+
+	if c.From() != nil {
+		if _, domain, err := SplitAddress(c.From().Address); err == nil && allowedDomain(g.Allowlist, normalizeName(domain)) {
+			return true
+		}
+	}
+
+	for _, entry := range g.Allowlist {
+		if net.ParseIP(entry) == nil && !strings.Contains(entry, "/") {
+			// only look the client up when there are domains
+			rdns := c.FCrDNS()
+			return rdns.Status == RDNSPass && allowedDomain(g.Allowlist, rdns.Hostname)
+		}
+	}
+
+	return false
+}
+
+// expired reports whether an entry is to be forgotten, unconfirmed ones after the retry window.
+func (g *Greylist) expired(entry *GreylistEntry, now time.Time) bool {
+	if entry.Passed {
+		return now.Sub(entry.LastSeen) >= g.expiry()
+	}
+
+	return now.Sub(entry.FirstSeen) >= g.retryWindow()
+}
+
+// purge drops the expired entries at most hourly.
+func (g *Greylist) purge(now time.Time) error {
+	g.mu.Lock()
+	if now.Sub(g.lastPurge) < time.Hour {
+		g.mu.Unlock()
+		return nil
+	}
+	g.lastPurge = now
+	g.mu.Unlock()
+
+	return g.store().Purge(func(entry *GreylistEntry) bool {
+		return g.expired(entry, now)
+	})
+}
+
+func (g *Greylist) store() GreylistStore {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Store == nil {
+		g.Store = NewMemoryGreylistStore()
+	}
+
+	return g.Store
+}
+
+func (g *Greylist) clock() time.Time {
+	if g.now == nil {
+		return time.Now()
+	}
+
+	return g.now()
+}
+
+func (g *Greylist) delay() time.Duration {
+	if g.Delay == 0 {
+		return DefaultGreylistDelay
+	}
+
+	return g.Delay
+}
+
+func (g *Greylist) retryWindow() time.Duration {
+	if g.RetryWindow == 0 {
+		return DefaultGreylistRetryWindow
+	}
+
+	return g.RetryWindow
+}
+
+func (g *Greylist) expiry() time.Duration {
+	if g.Expiry == 0 {
+		return DefaultGreylistExpiry
+	}
+
+	return g.Expiry
+}
+
+// clientNetwork returns the /24 or /64 network of ip.
+func clientNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// MemoryGreylistStore keeps the greylisting state in memory, it is lost on restart.
+type MemoryGreylistStore struct {
+	mu      sync.Mutex
+	entries map[string]GreylistEntry
+}
+
+func NewMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{entries: map[string]GreylistEntry{}}
+}
+
+func (s *MemoryGreylistStore) Get(key string) (*GreylistEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+func (s *MemoryGreylistStore) Put(key string, entry *GreylistEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = *entry
+
+	return nil
+}
+
+func (s *MemoryGreylistStore) Purge(expired func(entry *GreylistEntry) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, entry := range s.entries {
+		if expired(&entry) {
+			delete(s.entries, key)
+		}
+	}
+
+	return nil
+}
+
+// DefaultGreylistFlushInterval is how often FileGreylistStore saves its changes when FlushInterval is zero.
+const DefaultGreylistFlushInterval = time.Minute
+
+// FileGreylistStore keeps the greylisting state in memory and saves it as JSON to a file, at most every
+// FlushInterval and on Purge, which suits the few thousand triplets of a small site. Flush must be called
+// on shutdown, or the changes since the last save are lost.
+type FileGreylistStore struct {
+	// FlushInterval defaults to DefaultGreylistFlushInterval.
+	FlushInterval time.Duration
+
+	path   string
+	memory *MemoryGreylistStore
+	// save serializes the writes of the file
+	save sync.Mutex
+	// mu guards dirty and lastFlush
+	mu        sync.Mutex
+	dirty     bool
+	lastFlush time.Time
+}
+
+// NewFileGreylistStore loads the state from path, a missing file is an empty state.
+func NewFileGreylistStore(path string) (*FileGreylistStore, error) {
+	s := &FileGreylistStore{path: path, memory: NewMemoryGreylistStore(), lastFlush: time.Now()}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.memory.entries); err != nil {
+		return nil, err
+	}
+
+	// a file holding null
+	if s.memory.entries == nil {
+		s.memory.entries = map[string]GreylistEntry{}
+	}
+
+	return s, nil
+}
+
+func (s *FileGreylistStore) Get(key string) (*GreylistEntry, error) {
+	return s.memory.Get(key)
+}
+
+// Put saves the file once FlushInterval passed, unless another Put is already saving it.
+func (s *FileGreylistStore) Put(key string, entry *GreylistEntry) error {
+	s.memory.Put(key, entry)
+
+	interval := s.FlushInterval
+	if interval == 0 {
+		interval = DefaultGreylistFlushInterval
+	}
+
+	s.mu.Lock()
+	s.dirty = true
+	due := time.Since(s.lastFlush) >= interval
+	s.mu.Unlock()
+
+	if !due || !s.save.TryLock() {
+		return nil
+	}
+	defer s.save.Unlock()
+
+	return s.flush()
+}
+
+func (s *FileGreylistStore) Purge(expired func(entry *GreylistEntry) bool) error {
+	s.memory.Purge(expired)
+
+	s.save.Lock()
+	defer s.save.Unlock()
+
+	return s.flush()
+}
+
+// Flush saves the changes not saved yet, call it on shutdown.
+func (s *FileGreylistStore) Flush() error {
+	s.save.Lock()
+	defer s.save.Unlock()
+
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	return s.flush()
+}
+
+// flush replaces the file atomically, so a crash never leaves it half written. s.save must be held.
+func (s *FileGreylistStore) flush() (err error) {
+	// the changes made meanwhile are left for the next flush
+	s.mu.Lock()
+	s.dirty, s.lastFlush = false, time.Now()
+	s.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			s.mu.Lock()
+			s.dirty = true
+			s.mu.Unlock()
+		}
+	}()
+
+	s.memory.mu.Lock()
+	data, err := json.Marshal(s.memory.entries)
+	s.memory.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
@@ -0,0 +1,219 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGreylist(t *testing.T) {
+	now := time.Now()
+	g := &Greylist{AutoAllowlist: 2, now: func() time.Time { return now }}
+
+	s := NewSession(nil, nil)
+	c := &Context{session: s}
+
+	check := func(ip, from, to string) error {
+		s.From = &mail.Address{Address: from}
+		return g.check(c, net.ParseIP(ip), &mail.Address{Address: to})
+	}
+
+	require.Equal(t, ErrGreylisted, check("192.0.2.1", "a@example.org", "x@example.com"))
+
+	now = now.Add(time.Minute)
+	require.Equal(t, ErrGreylisted, check("192.0.2.1", "a@example.org", "x@example.com"))
+
+	// another host of the same /24 retries
+	now = now.Add(5 * time.Minute)
+	require.NoError(t, check("192.0.2.2", "A@example.org", "x@example.com"))
+	require.NoError(t, check("192.0.2.1", "a@example.org", "x@example.com"))
+
+	require.Equal(t, ErrGreylisted, check("192.0.2.1", "b@example.org", "x@example.com"))
+	require.Equal(t, ErrGreylisted, check("198.51.100.1", "a@example.org", "x@example.com"))
+
+	// the second passed triplet allowlists the client network
+	now = now.Add(10 * time.Minute)
+	require.NoError(t, check("192.0.2.1", "b@example.org", "x@example.com"))
+	require.NoError(t, check("192.0.2.1", "c@example.org", "y@example.com"))
+
+	// a client which never retried starts over after the retry window
+	now = now.Add(DefaultGreylistRetryWindow)
+	require.Equal(t, ErrGreylisted, check("198.51.100.1", "a@example.org", "x@example.com"))
+
+	// allowlisted clients expire without traffic
+	now = now.Add(DefaultGreylistExpiry)
+	require.Equal(t, ErrGreylisted, check("192.0.2.1", "d@example.org", "x@example.com"))
+}
+
+// slowGreylistStore leaves time to the concurrent checks between Get and Put.
+type slowGreylistStore struct {
+	GreylistStore
+}
+
+func (s slowGreylistStore) Get(key string) (*GreylistEntry, error) {
+	time.Sleep(time.Millisecond)
+	return s.GreylistStore.Get(key)
+}
+
+func TestGreylistConcurrent(t *testing.T) {
+	now := time.Now()
+	g := &Greylist{
+		Store:         slowGreylistStore{NewMemoryGreylistStore()},
+		AutoAllowlist: 1000,
+		now:           func() time.Time { return now },
+	}
+
+	const triplets = 50
+	for i := 0; i < triplets; i++ {
+		key := fmt.Sprintf("triplet 192.0.2.0/24 <sender%d@example.org> <x@example.com>", i)
+		require.NoError(t, g.store().Put(key, &GreylistEntry{FirstSeen: now.Add(-time.Hour), LastSeen: now.Add(-time.Hour)}))
+	}
+
+	// every passed triplet counts for the client network
+	var wg sync.WaitGroup
+	for i := 0; i < triplets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			s := NewSession(nil, nil)
+			s.From = &mail.Address{Address: fmt.Sprintf("sender%d@example.org", i)}
+			require.NoError(t, g.check(&Context{session: s}, net.ParseIP("192.0.2.1"), &mail.Address{Address: "x@example.com"}))
+		}(i)
+	}
+	wg.Wait()
+
+	client, err := g.store().Get("client 192.0.2.0/24")
+	require.NoError(t, err)
+	require.Equal(t, triplets, client.Count)
+}
+
+// blockingGreylistStore holds the Get of key until release is closed.
+type blockingGreylistStore struct {
+	GreylistStore
+	key     string
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s blockingGreylistStore) Get(key string) (*GreylistEntry, error) {
+	if key == s.key {
+		close(s.blocked)
+		<-s.release
+	}
+	return s.GreylistStore.Get(key)
+}
+
+func TestGreylistNetworksIndependent(t *testing.T) {
+	store := blockingGreylistStore{
+		GreylistStore: NewMemoryGreylistStore(),
+		key:           "client 192.0.2.0/24",
+		blocked:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	g := &Greylist{Store: store}
+	to := &mail.Address{Address: "x@example.com"}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- g.check(&Context{session: NewSession(nil, nil)}, net.ParseIP("192.0.2.1"), to)
+	}()
+	<-store.blocked
+
+	// a stalled client network doesn't hold the others
+	require.Equal(t, ErrGreylisted, g.check(&Context{session: NewSession(nil, nil)}, net.ParseIP("198.51.100.1"), to))
+
+	close(store.release)
+	require.Equal(t, ErrGreylisted, <-done)
+}
+
+func TestGreylistAllowlist(t *testing.T) {
+	g := &Greylist{Allowlist: []string{"192.0.2.0/24", "2001:db8::1", "bigmailer.example"}}
+
+	s := NewSession(nil, nil)
+	c := &Context{session: s}
+	s.From = &mail.Address{Address: "news@lists.bigmailer.example"}
+	to := &mail.Address{Address: "x@example.com"}
+
+	require.NoError(t, g.check(c, net.ParseIP("192.0.2.1"), to))
+	require.NoError(t, g.check(c, net.ParseIP("2001:db8::1"), to))
+	require.NoError(t, g.check(c, net.ParseIP("198.51.100.1"), to))
+
+	s.From = &mail.Address{Address: "a@example.org"}
+	require.Equal(t, ErrGreylisted, g.check(c, net.ParseIP("198.51.100.1"), to))
+}
+
+func TestFileGreylistStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+
+	store, err := NewFileGreylistStore(path)
+	require.NoError(t, err)
+
+	now := time.Now().Round(time.Second)
+	require.NoError(t, store.Put("old", &GreylistEntry{FirstSeen: now.Add(-time.Hour), LastSeen: now.Add(-time.Hour)}))
+	require.NoError(t, store.Put("new", &GreylistEntry{FirstSeen: now, LastSeen: now, Passed: true}))
+	require.NoError(t, store.Purge(func(entry *GreylistEntry) bool { return entry.LastSeen.Before(now) }))
+
+	store, err = NewFileGreylistStore(path)
+	require.NoError(t, err)
+
+	entry, err := store.Get("old")
+	require.NoError(t, err)
+	require.Nil(t, entry)
+
+	entry, err = store.Get("new")
+	require.NoError(t, err)
+	require.True(t, entry.Passed)
+	require.True(t, now.Equal(entry.LastSeen))
+
+	// changes are saved on Flush between the intervals
+	require.NoError(t, store.Put("newer", &GreylistEntry{FirstSeen: now, LastSeen: now}))
+
+	reloaded, err := NewFileGreylistStore(path)
+	require.NoError(t, err)
+	entry, err = reloaded.Get("newer")
+	require.NoError(t, err)
+	require.Nil(t, entry)
+
+	require.NoError(t, store.Flush())
+
+	reloaded, err = NewFileGreylistStore(path)
+	require.NoError(t, err)
+	entry, err = reloaded.Get("newer")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+}
+
+func TestFileGreylistStoreNull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("null"), 0600))
+
+	store, err := NewFileGreylistStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("key", &GreylistEntry{}))
+}
+
+func TestGreylistPolicy(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		RcptPolicies: []RcptPolicy{(&Greylist{}).Policy},
+		Handler:      func(c *Context) error { return nil },
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, msg := command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 451, code)
+	require.Equal(t, "4.7.1 Greylisted, please try again later", msg)
+}
@@ -1,4 +1,27 @@
 package smtpsrv
 
+import "net/mail"
+
 type HandlerFunc func(*Context) error
 type AuthFunc func(username, password string) error
+
+// Middleware wraps a HandlerFunc, e.g. to run checks before the message reaches the handler.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// chain wraps the handler with the middlewares, the first one being the outermost.
+func chain(handler HandlerFunc, middlewares []Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// HeloPolicy is consulted on HELO/EHLO, returning an error rejects the greeting.
+type HeloPolicy func(c *Context, helo string) error
+
+// MailPolicy is consulted on MAIL FROM, returning an error rejects the sender.
+type MailPolicy func(c *Context, from *mail.Address) error
+
+// RcptPolicy is consulted on RCPT TO, returning an error rejects the recipient.
+type RcptPolicy func(c *Context, to *mail.Address) error
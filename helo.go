@@ -0,0 +1,77 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	// ErrHeloInvalid is replied by StrictHelo for bare IP addresses and invalid hostnames.
+	ErrHeloInvalid = &smtp.SMTPError{
+		Code:         504,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+		Message:      "Helo command rejected: need fully-qualified hostname",
+	}
+
+	// ErrHeloForged is replied by StrictHelo when the client claims to be us.
+	ErrHeloForged = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Helo command rejected: you are not me",
+	}
+)
+
+// StrictHelo is a HeloPolicy that rejects bare IP addresses (address literals must be bracketed),
+// names which aren't a valid FQDN and names claiming to be our BannerDomain.
+func StrictHelo(c *Context, helo string) error {
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := strings.TrimPrefix(helo[1:len(helo)-1], "IPv6:")
+		if net.ParseIP(literal) == nil {
+			return ErrHeloInvalid
+		}
+
+		return nil
+	}
+
+	if net.ParseIP(helo) != nil || !isFQDN(helo) {
+		return ErrHeloInvalid
+	}
+
+	if strings.EqualFold(strings.TrimSuffix(helo, "."), c.session.config.BannerDomain) {
+		return ErrHeloForged
+	}
+
+	return nil
+}
+
+// isFQDN reports whether name is a syntactically valid fully-qualified hostname.
+func isFQDN(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+
+	// a numeric top level domain is an IP address in disguise
+	tld := labels[len(labels)-1]
+
+	return strings.Trim(tld, "0123456789") != ""
+}
@@ -0,0 +1,102 @@
+package smtpsrv
+
+import (
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrBareLineEnding is replied to messages with a bare CR or LF when ServerConfig.BareLineEndings rejects them.
+var ErrBareLineEnding = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+	Message:      "Bare CR or LF in message, lines must end with CRLF",
+}
+
+// BareLineEndingPolicy is what DATA does with a CR or LF not part of a CRLF. Such line endings are read
+// differently by other MTAs, e.g. <LF>.<LF> ending the message, which is how SMTP smuggling and header
+// injection work.
+type BareLineEndingPolicy int
+
+const (
+	// BareLineEndingsAccept keeps the message as received.
+	BareLineEndingsAccept BareLineEndingPolicy = iota
+	// BareLineEndingsReject replies ErrBareLineEnding.
+	BareLineEndingsReject
+	// BareLineEndingsNormalize turns each bare CR or LF into a CRLF.
+	BareLineEndingsNormalize
+)
+
+// lineEndingWriter finds the bare CR and LF written through it, and normalizes them when asked to.
+type lineEndingWriter struct {
+	w         io.Writer
+	normalize bool
+	// cr is set when the last byte written is a CR, held until the next byte tells if it's bare.
+	cr   bool
+	bare bool
+	buf  []byte
+}
+
+func (w *lineEndingWriter) Write(p []byte) (int, error) {
+	w.buf = w.buf[:0]
+	for _, b := range p {
+		if w.cr {
+			w.cr = false
+			w.buf = append(w.buf, '\r')
+			if b != '\n' {
+				w.bareLineEnding()
+			}
+		}
+
+		switch {
+		case b == '\r':
+			w.cr = true
+			continue
+		case b == '\n' && (len(w.buf) == 0 || w.buf[len(w.buf)-1] != '\r'):
+			w.bareLineEnding()
+		}
+
+		w.buf = append(w.buf, b)
+	}
+
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// bareLineEnding records a bare CR or LF, and completes it into a CRLF when normalizing: the CR is
+// at the end of buf, or the LF is about to be appended.
+func (w *lineEndingWriter) bareLineEnding() {
+	w.bare = true
+	if !w.normalize {
+		return
+	}
+
+	if n := len(w.buf); n > 0 && w.buf[n-1] == '\r' {
+		w.buf = append(w.buf, '\n')
+	} else {
+		w.buf = append(w.buf, '\r')
+	}
+}
+
+// Close writes the CR held at the end of the message, which is bare.
+func (w *lineEndingWriter) Close() error {
+	if !w.cr {
+		return nil
+	}
+
+	w.cr = false
+	w.buf = append(w.buf[:0], '\r')
+	w.bareLineEnding()
+
+	_, err := w.w.Write(w.buf)
+
+	return err
+}
+
+// BareLineEndings returns whether the client sent a message with a bare CR or LF during the session.
+func (c Context) BareLineEndings() bool {
+	return c.session.bareLineEndings
+}
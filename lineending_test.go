@@ -0,0 +1,136 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineEndingWriter(t *testing.T) {
+	tests := []struct {
+		in         string
+		bare       bool
+		normalized string
+	}{
+		{in: "a\r\nb\r\n", normalized: "a\r\nb\r\n"},
+		{in: "a\nb\r\n", bare: true, normalized: "a\r\nb\r\n"},
+		{in: "a\rb\r\n", bare: true, normalized: "a\r\nb\r\n"},
+		{in: "a\r\r\n", bare: true, normalized: "a\r\n\r\n"},
+		{in: "a\n.\n", bare: true, normalized: "a\r\n.\r\n"},
+		{in: "a\r.\r", bare: true, normalized: "a\r\n.\r\n"},
+		{in: "\n\r", bare: true, normalized: "\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		// every split exercises a CR held between writes
+		for split := 0; split <= len(tt.in); split++ {
+			for _, normalize := range []bool{false, true} {
+				var out bytes.Buffer
+				w := &lineEndingWriter{w: &out, normalize: normalize}
+
+				_, err := w.Write([]byte(tt.in[:split]))
+				require.NoError(t, err)
+				_, err = w.Write([]byte(tt.in[split:]))
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+
+				want := tt.in
+				if normalize {
+					want = tt.normalized
+				}
+				require.Equal(t, want, out.String(), "%q split at %d", tt.in, split)
+				require.Equal(t, tt.bare, w.bare, "%q split at %d", tt.in, split)
+			}
+		}
+	}
+}
+
+// sendRawMessage runs a transaction whose DATA is written as is, so the payload controls every line ending.
+func sendRawMessage(t *testing.T, addr, data string) (int, string) {
+	t.Helper()
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+
+	_, err := c.W.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, c.W.Flush())
+
+	code, msg, _ := c.ReadResponse(0)
+
+	// a single reply means the payload was read as one message, nothing was smuggled
+	quit, _ := command(t, c, "QUIT")
+	require.Equal(t, 221, quit)
+
+	return code, msg
+}
+
+func TestBareLineEndings(t *testing.T) {
+	const smuggled = "MAIL FROM:<admin@example.com>\r\nRCPT TO:<victim@example.com>\r\nDATA\r\nSubject: smuggled\r\n\r\nx\r\n"
+
+	tests := []struct {
+		name     string
+		policy   BareLineEndingPolicy
+		data     string
+		code     int
+		received string
+	}{
+		{name: "conforming", policy: BareLineEndingsReject, data: "Subject: a\r\n\r\nbody\r\n.\r\n", code: 250, received: "Subject: a\r\n\r\nbody\r\n"},
+		{name: "LF dot LF", policy: BareLineEndingsReject, data: "Subject: a\r\n\r\nbody\n.\n" + smuggled + ".\r\n", code: 554},
+		{name: "CR dot CR", policy: BareLineEndingsReject, data: "Subject: a\r\n\r\nbody\r.\r" + smuggled + ".\r\n", code: 554},
+		{name: "CRLF dot LF", policy: BareLineEndingsReject, data: "Subject: a\r\n\r\nbody\r\n.\n" + smuggled + ".\r\n", code: 554},
+		{name: "header injection", policy: BareLineEndingsReject, data: "Subject: a\nBcc: victim@example.com\r\n\r\nbody\r\n.\r\n", code: 554},
+		{
+			name:     "normalized",
+			policy:   BareLineEndingsNormalize,
+			data:     "Subject: a\nX-Test: b\r\n\r\nbody\n.\nnext\r\n.\r\n",
+			code:     250,
+			received: "Subject: a\r\nX-Test: b\r\n\r\nbody\r\n.\r\nnext\r\n",
+		},
+		{name: "accepted", data: "Subject: a\r\n\r\nbody\n.\nnext\r\n.\r\n", code: 250, received: "Subject: a\r\n\r\nbody\n.\nnext\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type delivery struct {
+				body string
+				bare bool
+			}
+			delivered := make(chan delivery, 2)
+
+			addr := startTestServer(t, &ServerConfig{
+				BareLineEndings: tt.policy,
+				Handler: func(c *Context) error {
+					body, err := ioutil.ReadAll(c.Body())
+					delivered <- delivery{string(body), c.BareLineEndings()}
+					return err
+				},
+			})
+
+			code, msg := sendRawMessage(t, addr, tt.data)
+			require.Equal(t, tt.code, code, msg)
+
+			if tt.code != 250 {
+				require.Equal(t, "5.5.2 Bare CR or LF in message, lines must end with CRLF", msg)
+				require.Len(t, delivered, 0)
+				return
+			}
+
+			require.Len(t, delivered, 1)
+			d := <-delivered
+			require.Equal(t, tt.received, d.body)
+			require.Equal(t, tt.name != "conforming", d.bare)
+		})
+	}
+}
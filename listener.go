@@ -0,0 +1,162 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// listener wraps the accepted connections, so the connect hooks run before the client is greeted.
+type listener struct {
+	net.Listener
+	config *ServerConfig
+	tls    bool
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: c, config: l.config, tls: l.tls, done: make(chan struct{})}, nil
+}
+
+// conn runs the connect hooks on its first write, which is the 220 greeting
+// (or the TLS handshake), so they run in the connection goroutine and never block Accept.
+type conn struct {
+	net.Conn
+	config    *ServerConfig
+	tls       bool
+	connected bool
+
+	// dnsbl is the result of the connect time blocklist check, handed to the session.
+	dnsbl *DNSBLResult
+	// session is the latest session, a new HELO starts another one. mu guards it as Close may run
+	// on the goroutine closing the server.
+	mu      sync.Mutex
+	session *Session
+
+	// early holds what a pregreeting client sent, line the verb of the command inspected for pipelining.
+	early      []byte
+	line       []byte
+	pregreet   bool
+	pipelining bool
+	greeted    bool
+
+	// closeAfterWrite disconnects the client once the pending reply is written.
+	closeAfterWrite bool
+
+	// done is closed with the connection, e.g. when the server closes, to interrupt the waits.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// connOf returns our conn under c, which may be wrapped by TLS, or nil.
+func connOf(c net.Conn) *conn {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+
+	cn, _ := c.(*conn)
+
+	return cn
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if !c.connected {
+		c.connected = true
+
+		if err := c.connect(); err != nil {
+			c.reject(err)
+			return 0, err
+		}
+	}
+
+	n, err := c.Conn.Write(p)
+	if c.closeAfterWrite {
+		c.Close()
+	}
+
+	return n, err
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		// the session outlives STARTTLS, its milters and OnDisconnect go with the connection
+		if s := c.currentSession(); s != nil {
+			s.milterQuit()
+
+			if s.config.OnDisconnect != nil {
+				s.config.OnDisconnect(&Context{session: s})
+			}
+		}
+	})
+
+	return err
+}
+
+func (c *conn) currentSession() *Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.session
+}
+
+func (c *conn) setSession(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.session = s
+}
+
+func (c *conn) connect() error {
+	if err := c.waitGreeting(); err != nil {
+		return err
+	}
+
+	if c.config.OnConnect != nil {
+		if err := c.config.OnConnect(c.RemoteAddr()); err != nil {
+			return err
+		}
+	}
+
+	if d := c.config.DNSBL; d != nil {
+		ctx, cancel := c.config.lookupContext()
+		defer cancel()
+
+		var ip net.IP
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+
+		c.dnsbl = d.CheckIP(ctx, c.config.resolver(), ip)
+		if d.Reject {
+			return c.dnsbl.Reject()
+		}
+	}
+
+	return nil
+}
+
+// reject replies instead of the greeting and closes the connection,
+// on implicit TLS the connection is just closed as there is no TLS session yet.
+func (c *conn) reject(err error) {
+	if !c.tls {
+		code, enhancedCode, msg := 554, smtp.EnhancedCode{5, 7, 1}, err.Error()
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			code, enhancedCode, msg = smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message
+		}
+
+		fmt.Fprintf(c.Conn, "%d %d.%d.%d %s\r\n", code, enhancedCode[0], enhancedCode[1], enhancedCode[2], msg)
+	}
+
+	c.Conn.Close()
+}
@@ -0,0 +1,35 @@
+package smtpsrv
+
+import (
+	"log"
+	"os"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Logger reports unexpected internal errors, it is shared with the underlying smtp server.
+type Logger = smtp.Logger
+
+// Metrics is notified about notable events, e.g. to feed prometheus counters.
+type Metrics interface {
+	Inc(name string)
+}
+
+// The metric names reported by the server.
+const (
+	MetricHandlerPanics = "handler_panics"
+)
+
+var defaultLogger Logger = log.New(os.Stderr, "smtpsrv ", log.LstdFlags)
+
+type nopMetrics struct{}
+
+func (nopMetrics) Inc(string) {}
+
+func (cfg *ServerConfig) logger() Logger {
+	if cfg.Logger == nil {
+		return defaultLogger
+	}
+
+	return cfg.Logger
+}
@@ -0,0 +1,123 @@
+package smtpsrv
+
+import (
+	"context"
+	"strings"
+)
+
+// MailableStatus tells how mail is delivered to a domain, as in RFC 5321 section 5.1.
+type MailableStatus string
+
+const (
+	// MailableMX is a domain with MX records.
+	MailableMX MailableStatus = "mx"
+	// MailableImplicit is a domain without MX records but with an address, the implicit MX.
+	MailableImplicit MailableStatus = "implicit"
+	// MailableNullMX is a domain declaring it accepts no mail with "MX 0 .", as in RFC 7505.
+	MailableNullMX MailableStatus = "null-mx"
+	// MailableNoDomain is a domain which doesn't exist or has neither MX nor address records.
+	MailableNoDomain MailableStatus = "nxdomain"
+	// MailableTemperror is a DNS failure, the check may succeed later.
+	MailableTemperror MailableStatus = "temperror"
+)
+
+// MailableResult is the outcome of a Mailable check.
+type MailableResult struct {
+	Status MailableStatus
+	Domain string
+	// Hosts are the MX hosts by preference, or the domain itself when implicit.
+	Hosts []string
+	Err   error
+}
+
+// OK reports whether the domain can receive mail.
+func (r *MailableResult) OK() bool {
+	return r.Status == MailableMX || r.Status == MailableImplicit
+}
+
+// CheckMailable looks up how mail is delivered to domain, errors are set on the result.
+func CheckMailable(ctx context.Context, resolver Resolver, domain string) *MailableResult {
+	result := &MailableResult{Domain: normalizeName(domain)}
+
+	mxs, err := resolver.LookupMX(ctx, result.Domain)
+	if err != nil && !isNotFound(err) {
+		result.Status, result.Err = MailableTemperror, err
+		return result
+	}
+
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		result.Status = MailableNullMX
+		return result
+	}
+
+	if len(mxs) > 0 {
+		result.Status = MailableMX
+		for _, mx := range mxs {
+			result.Hosts = append(result.Hosts, strings.TrimSuffix(mx.Host, "."))
+		}
+
+		return result
+	}
+
+	_, err = resolver.LookupIPAddr(ctx, result.Domain)
+	switch {
+	case err == nil:
+		result.Status, result.Hosts = MailableImplicit, []string{result.Domain}
+	case isNotFound(err):
+		result.Status, result.Err = MailableNoDomain, err
+	default:
+		result.Status, result.Err = MailableTemperror, err
+	}
+
+	return result
+}
+
+// mailable checks the domain of address once per transaction.
+func (c Context) mailable(address string) (*MailableResult, error) {
+	_, domain, err := SplitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := c.session.transaction()
+	domain = normalizeName(domain)
+	if result, ok := tx.mailable[domain]; ok {
+		return result, nil
+	}
+
+	ctx, cancel := c.session.lookupContext()
+	defer cancel()
+
+	if tx.mailable == nil {
+		tx.mailable = map[string]*MailableResult{}
+	}
+	tx.mailable[domain] = CheckMailable(ctx, c.session.resolver(), domain)
+
+	return tx.mailable[domain], nil
+}
+
+// Mailable checks whether the sender domain can receive mail, e.g. bounces.
+// It only errors on an unparsable address, lookup errors are set on the result.
+func (c Context) Mailable() (*MailableResult, error) {
+	var from string
+	if c.From() != nil {
+		from = c.From().Address
+	}
+
+	return c.mailable(from)
+}
+
+// MailableRecipients checks the domain of each envelope recipient, in order, e.g. before relaying.
+func (c Context) MailableRecipients() ([]*MailableResult, error) {
+	results := make([]*MailableResult, 0, len(c.session.recipients))
+	for _, to := range c.session.recipients {
+		result, err := c.mailable(to.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,75 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testMailableRecords = &FakeResolver{
+	MX: map[string][]*net.MX{
+		"example.org": {{Host: "mx1.example.org.", Pref: 10}, {Host: "mx2.example.org.", Pref: 20}},
+		"example.com": {{Host: ".", Pref: 0}},
+	},
+	IP: map[string][]net.IP{
+		"example.net": {net.ParseIP("192.0.2.1")},
+	},
+	Errors: map[string]error{
+		"broken.example.org": &net.DNSError{Err: "server misbehaving", IsTemporary: true},
+	},
+}
+
+func TestCheckMailable(t *testing.T) {
+	tests := []struct {
+		domain string
+		status MailableStatus
+		hosts  []string
+		ok     bool
+	}{
+		{domain: "Example.org", status: MailableMX, hosts: []string{"mx1.example.org", "mx2.example.org"}, ok: true},
+		{domain: "example.net", status: MailableImplicit, hosts: []string{"example.net"}, ok: true},
+		{domain: "example.com", status: MailableNullMX},
+		{domain: "missing.example.org", status: MailableNoDomain},
+		{domain: "broken.example.org", status: MailableTemperror},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			result := CheckMailable(context.Background(), testMailableRecords, tt.domain)
+
+			require.Equal(t, tt.status, result.Status)
+			require.Equal(t, tt.hosts, result.Hosts)
+			require.Equal(t, tt.ok, result.OK())
+		})
+	}
+}
+
+func TestContextMailable(t *testing.T) {
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{Resolver: testMailableRecords}
+	c := Context{session: s}
+
+	_, err := c.Mailable()
+	require.Error(t, err)
+
+	require.NoError(t, s.Mail("sender@example.org", nil))
+	result, err := c.Mailable()
+	require.NoError(t, err)
+	require.Equal(t, MailableMX, result.Status)
+
+	require.NoError(t, s.Rcpt("a@example.net", nil))
+	require.NoError(t, s.Rcpt("b@example.com", nil))
+	require.Equal(t, []*mail.Address{{Address: "a@example.net"}, {Address: "b@example.com"}}, c.Recipients())
+
+	results, err := c.MailableRecipients()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, MailableImplicit, results[0].Status)
+	require.Equal(t, MailableNullMX, results[1].Status)
+
+	s.Reset()
+	require.Empty(t, c.Recipients())
+}
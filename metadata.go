@@ -0,0 +1,107 @@
+package smtpsrv
+
+import "sync"
+
+// MetaQuarantine is set in TxMeta by the checks asking for the message to be quarantined, the value names the check.
+const MetaQuarantine = "smtpsrv.quarantine"
+
+// Metadata is a key/value store shared by the handler, middlewares and policies, e.g. to pass a spam score along.
+// The zero value is ready to use and it is safe for concurrent use.
+type Metadata struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (m *Metadata) Set(key string, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values == nil {
+		m.values = map[string]interface{}{}
+	}
+
+	m.values[key] = value
+}
+
+func (m *Metadata) Get(key string) (interface{}, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.values[key]
+
+	return value, ok
+}
+
+func (m *Metadata) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, key)
+}
+
+// GetString returns the value of key if it is a string, or "" otherwise.
+func (m *Metadata) GetString(key string) string {
+	value, _ := m.Get(key)
+	s, _ := value.(string)
+
+	return s
+}
+
+// GetInt returns the value of key if it is an int, or 0 otherwise.
+func (m *Metadata) GetInt(key string) int {
+	value, _ := m.Get(key)
+	i, _ := value.(int)
+
+	return i
+}
+
+// GetFloat64 returns the value of key if it is a float64, or 0 otherwise.
+func (m *Metadata) GetFloat64(key string) float64 {
+	value, _ := m.Get(key)
+	f, _ := value.(float64)
+
+	return f
+}
+
+// GetBool returns the value of key if it is a bool, or false otherwise.
+func (m *Metadata) GetBool(key string) bool {
+	value, _ := m.Get(key)
+	b, _ := value.(bool)
+
+	return b
+}
+
+// Keys returns the stored keys in no particular order.
+func (m *Metadata) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// copyFrom replaces the values of m with a copy of the values of src.
+func (m *Metadata) copyFrom(src *Metadata) {
+	src.mu.RLock()
+	values := make(map[string]interface{}, len(src.values))
+	for key, value := range src.values {
+		values[key] = value
+	}
+	src.mu.RUnlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values = values
+}
+
+func (m *Metadata) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values = nil
+}
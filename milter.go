@@ -0,0 +1,790 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultMilterTimeout bounds the dial and every reply of a milter when Milter.Timeout is zero.
+const DefaultMilterTimeout = 10 * time.Second
+
+var (
+	// ErrMilterReject is replied when a milter rejects without its own reply.
+	ErrMilterReject = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Command rejected",
+	}
+
+	// ErrMilterTempfail is replied when a milter tempfails, or fails and isn't FailOpen.
+	ErrMilterTempfail = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Service unavailable - try again later",
+	}
+)
+
+// Milter is a Sendmail milter filter, e.g. rspamd, OpenDKIM or clamav-milter, spoken to with the
+// version 6 protocol. A connection is opened per SMTP session, see ServerConfig.Milters.
+type Milter struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout bounds the dial and every reply, it defaults to DefaultMilterTimeout.
+	Timeout time.Duration
+	// FailOpen ignores the milter when it's unreachable or fails, instead of a 451.
+	FailOpen bool
+}
+
+// milter commands, sent to the filter
+const (
+	milterAbort   = 'A'
+	milterBody    = 'B'
+	milterConnect = 'C'
+	milterMacro   = 'D'
+	milterEOB     = 'E'
+	milterHelo    = 'H'
+	milterHeader  = 'L'
+	milterMail    = 'M'
+	milterEOH     = 'N'
+	milterOptNeg  = 'O'
+	milterQuit    = 'Q'
+	milterRcpt    = 'R'
+	milterData    = 'T'
+)
+
+// milter replies and modifications, sent by the filter
+const (
+	milterAddRcpt     = '+'
+	milterDelRcpt     = '-'
+	milterAddRcptPar  = '2'
+	milterAccept      = 'a'
+	milterReplBody    = 'b'
+	milterContinue    = 'c'
+	milterDiscard     = 'd'
+	milterChgFrom     = 'e'
+	milterAddHeader   = 'h'
+	milterInsHeader   = 'i'
+	milterChgHeader   = 'm'
+	milterProgress    = 'p'
+	milterQuarantine  = 'q'
+	milterReject      = 'r'
+	milterSkip        = 's'
+	milterTempfail    = 't'
+	milterReplyCode   = 'y'
+	milterMaxBodyData = 65535
+)
+
+// milter actions we allow, all of SMFIF_ADDHDRS to SMFIF_ADDRCPT_PAR
+const milterActions = 0xff
+
+// milter protocol flags
+const (
+	milterNoConnect  = 1 << 0
+	milterNoHelo     = 1 << 1
+	milterNoMail     = 1 << 2
+	milterNoRcpt     = 1 << 3
+	milterNoBody     = 1 << 4
+	milterNoHeaders  = 1 << 5
+	milterNoEOH      = 1 << 6
+	milterNRHeader   = 1 << 7
+	milterNoData     = 1 << 9
+	milterSkipOK     = 1 << 10
+	milterRcptRej    = 1 << 11
+	milterNRConnect  = 1 << 12
+	milterNRHelo     = 1 << 13
+	milterNRMail     = 1 << 14
+	milterNRRcpt     = 1 << 15
+	milterNRData     = 1 << 16
+	milterNREOH      = 1 << 18
+	milterNRBody     = 1 << 19
+	milterHeaderLead = 1 << 20
+
+	// we offer all the steps but RCPT_REJ, as rejected recipients are never sent
+	milterProtocol = 0x1fffff &^ milterRcptRej
+)
+
+// errMilterDiscard tells the transaction is to be accepted and dropped.
+var errMilterDiscard = errors.New("milter: discard")
+
+// milterModification is a change requested by a milter at the end of the message.
+type milterModification struct {
+	code byte
+	data []byte
+}
+
+// milterClient is the connection of a session to a milter.
+type milterClient struct {
+	milter   *Milter
+	conn     net.Conn
+	r        *bufio.Reader
+	protocol uint32
+
+	// accepted stops the milter for the connection, acceptedTx for the transaction only.
+	accepted   bool
+	acceptedTx bool
+	// inTx tells an abort is needed to end the transaction.
+	inTx bool
+	skip bool
+}
+
+func (m *Milter) timeout() time.Duration {
+	if m.Timeout == 0 {
+		return DefaultMilterTimeout
+	}
+
+	return m.Timeout
+}
+
+// dial connects to the milter and negotiates the protocol.
+func (m *Milter) dial() (*milterClient, error) {
+	conn, err := net.DialTimeout(m.Network, m.Address, m.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	client := &milterClient{milter: m, conn: conn, r: bufio.NewReader(conn)}
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, 6)
+	binary.BigEndian.PutUint32(data[4:], milterActions)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+	if err := client.write(milterOptNeg, data); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	code, data, err := client.read()
+	if err == nil && (code != milterOptNeg || len(data) < 12) {
+		err = fmt.Errorf("milter: unexpected negotiation reply %q", code)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocol
+
+	return client, nil
+}
+
+func (m *milterClient) write(code byte, data []byte) error {
+	m.conn.SetWriteDeadline(time.Now().Add(m.milter.timeout()))
+
+	return writeMilterPacket(m.conn, code, data)
+}
+
+func (m *milterClient) read() (byte, []byte, error) {
+	m.conn.SetReadDeadline(time.Now().Add(m.milter.timeout()))
+
+	return readMilterPacket(m.r)
+}
+
+// macros sends the macros of the next command, milters don't reply to them.
+func (m *milterClient) macros(cmd byte, macros ...string) error {
+	return m.write(milterMacro, append([]byte{cmd}, milterStrings(macros...)...))
+}
+
+// command sends a command and waits for its reply unless noReply is negotiated, the reply is
+// turned into nil to go on, an *smtp.SMTPError or errMilterDiscard.
+func (m *milterClient) command(cmd byte, data []byte, noReply uint32) error {
+	if err := m.write(cmd, data); err != nil {
+		return err
+	}
+
+	if m.protocol&noReply != 0 {
+		return nil
+	}
+
+	for {
+		code, data, err := m.read()
+		if err != nil {
+			return err
+		}
+
+		if code == milterProgress {
+			continue
+		}
+
+		return m.action(cmd, code, data)
+	}
+}
+
+// action interprets a final reply.
+func (m *milterClient) action(cmd, code byte, data []byte) error {
+	switch code {
+	case milterContinue:
+		return nil
+	case milterAccept:
+		if cmd == milterConnect || cmd == milterHelo {
+			m.accepted = true
+		}
+		m.acceptedTx = true
+		return nil
+	case milterSkip:
+		m.skip = true
+		return nil
+	case milterDiscard:
+		return errMilterDiscard
+	case milterReject:
+		return ErrMilterReject
+	case milterTempfail:
+		return ErrMilterTempfail
+	case milterReplyCode:
+		return parseMilterReply(data)
+	default:
+		return fmt.Errorf("milter: unexpected reply %q to %q", code, cmd)
+	}
+}
+
+// endOfMessage sends the end of the body and collects the modifications until the final reply.
+func (m *milterClient) endOfMessage() ([]milterModification, error) {
+	if err := m.write(milterEOB, nil); err != nil {
+		return nil, err
+	}
+
+	var mods []milterModification
+	for {
+		code, data, err := m.read()
+		if err != nil {
+			return nil, err
+		}
+
+		switch code {
+		case milterProgress:
+			continue
+		case milterAddRcpt, milterDelRcpt, milterAddRcptPar, milterReplBody, milterChgFrom,
+			milterAddHeader, milterInsHeader, milterChgHeader, milterQuarantine:
+			mods = append(mods, milterModification{code: code, data: data})
+			continue
+		}
+
+		return mods, m.action(milterEOB, code, data)
+	}
+}
+
+func (m *milterClient) close() {
+	m.write(milterQuit, nil)
+	m.conn.Close()
+}
+
+// writeMilterPacket writes the length, including the code, the code and the data.
+func writeMilterPacket(w io.Writer, code byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = code
+	copy(packet[5:], data)
+
+	_, err := w.Write(packet)
+
+	return err
+}
+
+func readMilterPacket(r io.Reader) (byte, []byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+
+	if size == 0 || size > 1<<20 {
+		return 0, nil, fmt.Errorf("milter: invalid packet size %d", size)
+	}
+
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+// milterStrings encodes NUL terminated strings.
+func milterStrings(strs ...string) []byte {
+	var b bytes.Buffer
+	for _, s := range strs {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+
+	return b.Bytes()
+}
+
+// splitMilterStrings decodes NUL terminated strings.
+func splitMilterStrings(data []byte) []string {
+	strs := strings.Split(string(data), "\x00")
+	if len(strs) > 0 && strs[len(strs)-1] == "" {
+		strs = strs[:len(strs)-1]
+	}
+
+	return strs
+}
+
+// parseMilterReply parses a custom reply such as "550 5.7.1 Spam", multiline replies are joined.
+func parseMilterReply(data []byte) error {
+	text := strings.TrimRight(string(bytes.TrimRight(data, "\x00")), "\r\n")
+	if len(text) < 3 {
+		return ErrMilterReject
+	}
+
+	code, err := strconv.Atoi(text[:3])
+	if err != nil || code < 400 || code > 599 {
+		return ErrMilterReject
+	}
+
+	smtpErr := &smtp.SMTPError{Code: code, EnhancedCode: smtp.NoEnhancedCode}
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 4 {
+			lines = append(lines, line[4:])
+		}
+	}
+
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+
+		var enhanced smtp.EnhancedCode
+		if n, _ := fmt.Sscanf(parts[0], "%d.%d.%d", &enhanced[0], &enhanced[1], &enhanced[2]); n == 3 {
+			smtpErr.EnhancedCode = enhanced
+			lines[i] = ""
+			if len(parts) > 1 {
+				lines[i] = parts[1]
+			}
+		}
+	}
+
+	smtpErr.Message = strings.Join(lines, " ")
+
+	return smtpErr
+}
+
+// milterFailed decides about a milter which couldn't be spoken to, FailOpen ones are dropped.
+func (s *Session) milterFailed(m *milterClient, err error) error {
+	s.logger().Printf("milter %s: %v", m.milter.Address, err)
+
+	m.conn.Close()
+	m.accepted = true
+
+	if m.milter.FailOpen {
+		return nil
+	}
+
+	return ErrMilterTempfail
+}
+
+// eachMilter runs fn on the milters still interested in the transaction, until one rejects.
+func (s *Session) eachMilter(fn func(m *milterClient) error) error {
+	for _, m := range s.milters {
+		if m.accepted || m.acceptedTx {
+			continue
+		}
+
+		err := fn(m)
+		if _, ok := err.(*smtp.SMTPError); ok || err == errMilterDiscard || err == nil {
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := s.milterFailed(m, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// milterHelo connects to the milters on the first HELO, a later HELO reuses the connections of prev.
+func (s *Session) milterHelo(prev *Session) error {
+	if len(s.config.Milters) == 0 {
+		return nil
+	}
+
+	if prev != nil {
+		s.milters, prev.milters = prev.milters, nil
+	} else {
+		for _, milter := range s.config.Milters {
+			m, err := milter.dial()
+			if err != nil {
+				s.logger().Printf("milter %s: %v", milter.Address, err)
+				if milter.FailOpen {
+					continue
+				}
+
+				return ErrMilterTempfail
+			}
+
+			s.milters = append(s.milters, m)
+
+			if err := s.milterConnect(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.eachMilter(func(m *milterClient) error {
+		if m.protocol&milterNoHelo != 0 {
+			return nil
+		}
+
+		return m.command(milterHelo, milterStrings(s.helo), milterNRHelo)
+	})
+}
+
+// milterConnect describes the client to a new milter connection.
+func (s *Session) milterConnect(m *milterClient) error {
+	if m.protocol&milterNoConnect != 0 {
+		return nil
+	}
+
+	ip := Context{session: s}.RemoteIP()
+
+	hostname := "unknown"
+	if s.rdns != nil && s.rdns.Status == RDNSPass {
+		hostname = s.rdns.Hostname
+	} else if ip != nil {
+		hostname = "[" + ip.String() + "]"
+	}
+
+	data := milterStrings(hostname)
+	if ip == nil {
+		data = append(data, 'U')
+	} else {
+		family := byte('4')
+		if ip.To4() == nil {
+			family = '6'
+		}
+
+		var port uint16
+		if addr, ok := s.remoteAddr().(*net.TCPAddr); ok {
+			port = uint16(addr.Port)
+		}
+
+		data = append(data, family, byte(port>>8), byte(port))
+		data = append(data, milterStrings(ip.String())...)
+	}
+
+	err := m.macros(milterConnect, "j", s.config.BannerDomain, "{daemon_name}", s.config.BannerDomain)
+	if err == nil {
+		err = m.command(milterConnect, data, milterNRConnect)
+	}
+
+	if _, ok := err.(*smtp.SMTPError); ok || err == nil || err == errMilterDiscard {
+		return err
+	}
+
+	return s.milterFailed(m, err)
+}
+
+// milterMail starts the transaction of the milters.
+func (s *Session) milterMail(from *mail.Address) error {
+	return s.eachMilter(func(m *milterClient) error {
+		m.inTx = true
+		if m.protocol&milterNoMail != 0 {
+			return nil
+		}
+
+		macros := []string{"i", s.transaction().id, "{mail_addr}", from.Address}
+		if s.username != nil {
+			macros = append(macros, "{auth_authen}", *s.username)
+		}
+
+		if err := m.macros(milterMail, macros...); err != nil {
+			return err
+		}
+
+		return m.command(milterMail, milterStrings("<"+from.Address+">"), milterNRMail)
+	})
+}
+
+func (s *Session) milterRcpt(to *mail.Address) error {
+	return s.eachMilter(func(m *milterClient) error {
+		if m.protocol&milterNoRcpt != 0 {
+			return nil
+		}
+
+		if err := m.macros(milterRcpt, "{rcpt_addr}", to.Address); err != nil {
+			return err
+		}
+
+		return m.command(milterRcpt, milterStrings("<"+to.Address+">"), milterNRRcpt)
+	})
+}
+
+// milterData sends the message to the milters and applies their modifications to the spool.
+func (s *Session) milterData() error {
+	tx := s.transaction()
+
+	fields, _, err := readRawHeader(tx.body.Reader())
+	if err != nil {
+		fields = nil
+	}
+
+	var mods []milterModification
+	err = s.eachMilter(func(m *milterClient) error {
+		if m.protocol&milterNoData == 0 {
+			if err := m.command(milterData, nil, milterNRData); err != nil {
+				return err
+			}
+		}
+
+		if m.protocol&milterNoHeaders == 0 {
+			for _, field := range fields {
+				if err := m.command(milterHeader, milterHeaderData(field, m.protocol), milterNRHeader); err != nil || m.acceptedTx {
+					return err
+				}
+			}
+		}
+
+		if m.protocol&milterNoEOH == 0 {
+			if err := m.command(milterEOH, nil, milterNREOH); err != nil || m.acceptedTx {
+				return err
+			}
+		}
+
+		if m.protocol&milterNoBody == 0 {
+			if err := s.milterBody(m); err != nil || m.acceptedTx {
+				return err
+			}
+		}
+
+		if err := m.macros(milterEOB, "i", tx.id); err != nil {
+			return err
+		}
+
+		milterMods, err := m.endOfMessage()
+		if err != nil {
+			return err
+		}
+
+		m.inTx = false
+		mods = append(mods, milterMods...)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(mods) == 0 {
+		return nil
+	}
+
+	return s.applyMilterModifications(mods)
+}
+
+// milterBody sends the body in chunks, until the milter asks to skip the rest.
+func (s *Session) milterBody(m *milterClient) error {
+	_, body, err := readRawHeader(s.transaction().body.Reader())
+	if err != nil {
+		return nil
+	}
+
+	m.skip = false
+
+	chunk := make([]byte, milterMaxBodyData)
+	for !m.skip {
+		n, err := io.ReadFull(body, chunk)
+		if n > 0 {
+			if err := m.command(milterBody, chunk[:n], milterNRBody); err != nil || m.acceptedTx {
+				return err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// milterHeaderData splits a raw field into its NUL terminated name and value, as milters expect them.
+func milterHeaderData(field string, protocol uint32) []byte {
+	name := fieldName(field)
+
+	value := strings.TrimSuffix(field[len(name)+1:], "\r\n")
+	if protocol&milterHeaderLead == 0 {
+		value = strings.TrimLeft(value, " ")
+	}
+
+	return milterStrings(name, strings.Replace(value, "\r\n", "\n", -1))
+}
+
+// milterAbort ends the transaction of the milters.
+func (s *Session) milterAbort() {
+	for _, m := range s.milters {
+		if m.inTx && !m.accepted {
+			if err := m.write(milterAbort, nil); err != nil {
+				s.milterFailed(m, err)
+			}
+		}
+
+		m.inTx, m.acceptedTx = false, false
+	}
+}
+
+// milterDiscard marks the transaction to be dropped on a discard, other errors are returned.
+func (s *Session) milterDiscard(err error) error {
+	if err == errMilterDiscard {
+		s.transaction().discard = true
+		return nil
+	}
+
+	return err
+}
+
+// milterQuit closes the milter connections.
+func (s *Session) milterQuit() {
+	for _, m := range s.milters {
+		m.close()
+	}
+
+	s.milters = nil
+}
+
+// applyMilterModifications rewrites the spooled message and the envelope as requested.
+func (s *Session) applyMilterModifications(mods []milterModification) error {
+	tx := s.transaction()
+
+	fields, br, err := readRawHeader(tx.body.Reader())
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = br
+	var replacedBody *bytes.Buffer
+
+	for _, mod := range mods {
+		switch mod.code {
+		case milterAddHeader:
+			if strs := splitMilterStrings(mod.data); len(strs) == 2 {
+				fields = append(fields, milterField(strs[0], strs[1]))
+			}
+		case milterInsHeader, milterChgHeader:
+			if len(mod.data) < 4 {
+				continue
+			}
+
+			index := int(binary.BigEndian.Uint32(mod.data))
+			strs := splitMilterStrings(mod.data[4:])
+			if len(strs) == 1 {
+				strs = append(strs, "")
+			}
+			if len(strs) != 2 {
+				continue
+			}
+
+			if mod.code == milterInsHeader {
+				if index > len(fields) {
+					index = len(fields)
+				}
+
+				fields = append(fields[:index], append([]string{milterField(strs[0], strs[1])}, fields[index:]...)...)
+				continue
+			}
+
+			fields = changeMilterField(fields, strs[0], index, strs[1])
+		case milterReplBody:
+			if replacedBody == nil {
+				replacedBody = &bytes.Buffer{}
+			}
+			replacedBody.Write(mod.data)
+		case milterChgFrom:
+			if strs := splitMilterStrings(mod.data); len(strs) > 0 {
+				s.From = &mail.Address{Address: strings.Trim(strs[0], "<>")}
+			}
+		case milterAddRcpt, milterAddRcptPar:
+			if strs := splitMilterStrings(mod.data); len(strs) > 0 {
+				to := &mail.Address{Address: strings.Trim(strs[0], "<>")}
+				s.recipients = append(s.recipients, to)
+				s.To = to
+			}
+		case milterDelRcpt:
+			if strs := splitMilterStrings(mod.data); len(strs) > 0 {
+				s.deleteRecipient(strings.Trim(strs[0], "<>"))
+			}
+		case milterQuarantine:
+			s.txMeta.Set(MetaQuarantine, "milter: "+strings.Join(splitMilterStrings(mod.data), " "))
+		}
+	}
+
+	if replacedBody != nil {
+		body = replacedBody
+	}
+
+	return s.rewriteMessage(fields, body)
+}
+
+// milterField formats a header field from a milter, whose folded lines end with a bare LF.
+func milterField(name, value string) string {
+	if !strings.HasPrefix(value, " ") && !strings.HasPrefix(value, "\t") {
+		value = " " + value
+	}
+
+	value = strings.Replace(strings.Replace(value, "\r\n", "\n", -1), "\n", "\r\n", -1)
+
+	return name + ":" + value + "\r\n"
+}
+
+// changeMilterField replaces the index-th (from 1) field named name, an empty value deletes it.
+func changeMilterField(fields []string, name string, index int, value string) []string {
+	for i, field := range fields {
+		if !strings.EqualFold(fieldName(field), name) {
+			continue
+		}
+
+		if index--; index > 0 {
+			continue
+		}
+
+		if value == "" {
+			return append(fields[:i], fields[i+1:]...)
+		}
+
+		fields[i] = milterField(name, value)
+		return fields
+	}
+
+	// a missing field is added, as sendmail does
+	if value != "" {
+		fields = append(fields, milterField(name, value))
+	}
+
+	return fields
+}
+
+// deleteRecipient removes address from the envelope recipients.
+func (s *Session) deleteRecipient(address string) {
+	recipients := s.recipients[:0]
+	for _, to := range s.recipients {
+		if !strings.EqualFold(to.Address, address) {
+			recipients = append(recipients, to)
+		}
+	}
+
+	s.recipients = recipients
+
+	s.To = nil
+	if len(recipients) > 0 {
+		s.To = recipients[len(recipients)-1]
+	}
+}
@@ -0,0 +1,361 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMilter is an in-process milter which records the commands it receives.
+type fakeMilter struct {
+	protocol uint32
+	// respond returns the replies to a command, a continue when empty.
+	respond func(cmd byte, data []byte) []milterModification
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func startFakeMilter(t *testing.T, m *fakeMilter) *Milter {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go m.serve(conn)
+		}
+	}()
+
+	return &Milter{Network: "tcp", Address: l.Addr().String()}
+}
+
+func (m *fakeMilter) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		cmd, data, err := readMilterPacket(r)
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.commands = append(m.commands, describeMilterCommand(cmd, data))
+		m.mu.Unlock()
+
+		switch cmd {
+		case milterOptNeg:
+			reply := make([]byte, 12)
+			binary.BigEndian.PutUint32(reply, 6)
+			binary.BigEndian.PutUint32(reply[4:], milterActions)
+			binary.BigEndian.PutUint32(reply[8:], m.protocol)
+			writeMilterPacket(conn, milterOptNeg, reply)
+			continue
+		case milterMacro, milterAbort:
+			continue
+		case milterQuit:
+			return
+		case milterHeader:
+			if m.protocol&milterNRHeader != 0 {
+				continue
+			}
+		}
+
+		var replies []milterModification
+		if m.respond != nil {
+			replies = m.respond(cmd, data)
+		}
+		if len(replies) == 0 {
+			replies = []milterModification{{code: milterContinue}}
+		}
+
+		for _, reply := range replies {
+			writeMilterPacket(conn, reply.code, reply.data)
+		}
+	}
+}
+
+func (m *fakeMilter) received() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string{}, m.commands...)
+}
+
+// describeMilterCommand formats a command as "H client.example.org", macros and negotiation by code only.
+func describeMilterCommand(cmd byte, data []byte) string {
+	switch cmd {
+	case milterOptNeg, milterMacro, milterData, milterEOH, milterEOB, milterAbort, milterQuit:
+		return string(cmd)
+	case milterConnect:
+		return string(cmd) + " " + splitMilterStrings(data)[0]
+	case milterBody:
+		return string(cmd) + " " + string(data)
+	}
+
+	return string(cmd) + " " + strings.Join(splitMilterStrings(data), " ")
+}
+
+// sendTestMessage runs a transaction and returns the reply to the final dot.
+func sendTestMessage(t *testing.T, addr string, rcpts ...string) (int, string) {
+	t.Helper()
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, msg := command(t, c, "MAIL FROM:<sender@example.org>")
+	if code != 250 {
+		return code, msg
+	}
+
+	for _, rcpt := range rcpts {
+		code, msg = command(t, c, "RCPT TO:<%s>", rcpt)
+		if code != 250 {
+			return code, msg
+		}
+	}
+
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+
+	return command(t, c, "Subject: test\r\nX-Spam: no\r\n\r\nbody\r\n.")
+}
+
+func TestMilter(t *testing.T) {
+	fake := &fakeMilter{
+		protocol: milterNRHeader,
+		respond: func(cmd byte, data []byte) []milterModification {
+			if cmd != milterEOB {
+				return nil
+			}
+
+			index := make([]byte, 4)
+			binary.BigEndian.PutUint32(index, 1)
+
+			return []milterModification{
+				{code: milterAddHeader, data: milterStrings("X-Milter", "scanned")},
+				{code: milterInsHeader, data: append([]byte{0, 0, 0, 0}, milterStrings("X-First", "yes")...)},
+				{code: milterChgHeader, data: append(index, milterStrings("Subject", "[SPAM] test")...)},
+				{code: milterChgHeader, data: append(index, milterStrings("X-Spam", "")...)},
+				{code: milterAddRcpt, data: milterStrings("<archive@example.com>")},
+				{code: milterDelRcpt, data: milterStrings("<recipient@example.com>")},
+				{code: milterQuarantine, data: milterStrings("looks bad")},
+				{code: milterAccept},
+			}
+		},
+	}
+
+	type delivery struct {
+		body       string
+		recipients []*mail.Address
+		quarantine string
+	}
+	delivered := make(chan delivery, 1)
+
+	addr := startTestServer(t, &ServerConfig{
+		Milters: []*Milter{startFakeMilter(t, fake)},
+		Handler: func(c *Context) error {
+			body, err := ioutil.ReadAll(c.Body())
+			delivered <- delivery{string(body), c.Recipients(), c.TxMeta().GetString(MetaQuarantine)}
+			return err
+		},
+	})
+
+	code, _ := sendTestMessage(t, addr, "recipient@example.com", "other@example.com")
+	require.Equal(t, 250, code)
+
+	d := <-delivered
+	require.Equal(t, "X-First: yes\r\nSubject: [SPAM] test\r\nX-Milter: scanned\r\n\r\nbody\r\n", d.body)
+	require.Equal(t, []*mail.Address{{Address: "other@example.com"}, {Address: "archive@example.com"}}, d.recipients)
+	require.Equal(t, "milter: looks bad", d.quarantine)
+
+	require.Equal(t, []string{
+		"O", "D", "C [127.0.0.1]", "H client.example.org",
+		"D", "M <sender@example.org>",
+		"D", "R <recipient@example.com>",
+		"D", "R <other@example.com>",
+		"T", "L Subject test", "L X-Spam no", "N", "B body\r\n", "D", "E",
+	}, fake.received()[:17])
+}
+
+func TestMilterActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     byte
+		reply   milterModification
+		code    int
+		handled bool
+	}{
+		{name: "reject recipient", cmd: milterRcpt, reply: milterModification{code: milterReplyCode, data: milterStrings("550 5.1.1 No such user")}, code: 550},
+		{name: "tempfail sender", cmd: milterMail, reply: milterModification{code: milterTempfail}, code: 451},
+		{name: "reject message", cmd: milterEOB, reply: milterModification{code: milterReject}, code: 550},
+		{name: "discard message", cmd: milterEOB, reply: milterModification{code: milterDiscard}, code: 250},
+		{name: "accept early", cmd: milterMail, reply: milterModification{code: milterAccept}, code: 250, handled: true},
+		{name: "replace body", cmd: milterEOB, reply: milterModification{code: milterReplBody, data: []byte("replaced\r\n")}, code: 250, handled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeMilter{respond: func(cmd byte, data []byte) []milterModification {
+				if cmd != tt.cmd {
+					return nil
+				}
+
+				if tt.reply.code == milterReplBody {
+					return []milterModification{tt.reply, {code: milterContinue}}
+				}
+
+				return []milterModification{tt.reply}
+			}}
+
+			handled := make(chan string, 1)
+			addr := startTestServer(t, &ServerConfig{
+				Milters: []*Milter{startFakeMilter(t, fake)},
+				Handler: func(c *Context) error {
+					body, _ := ioutil.ReadAll(c.Body())
+					handled <- string(body)
+					return nil
+				},
+			})
+
+			code, _ := sendTestMessage(t, addr, "recipient@example.com")
+			require.Equal(t, tt.code, code)
+			require.Equal(t, tt.handled, len(handled) == 1)
+
+			if tt.reply.code == milterReplBody {
+				require.Equal(t, "Subject: test\r\nX-Spam: no\r\n\r\nreplaced\r\n", <-handled)
+			}
+		})
+	}
+}
+
+func TestMilterRejectedHelo(t *testing.T) {
+	fake := &fakeMilter{}
+	addr := startTestServer(t, &ServerConfig{
+		Milters: []*Milter{startFakeMilter(t, fake)},
+		HeloPolicies: []HeloPolicy{
+			func(c *Context, helo string) error {
+				if helo == "bad.example.org" {
+					return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Bad HELO"}
+				}
+				return nil
+			},
+		},
+		Handler: func(c *Context) error { return nil },
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "EHLO bad.example.org")
+	require.Equal(t, 550, code)
+
+	// the milter connection of the first EHLO goes on
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	finishTransaction(t, c)
+
+	code, _ = command(t, c, "QUIT")
+	require.Equal(t, 221, code)
+
+	require.Eventually(t, func() bool {
+		received := fake.received()
+		return len(received) > 0 && received[len(received)-1] == "Q"
+	}, time.Second, 10*time.Millisecond)
+
+	received := fake.received()
+	require.Equal(t, []string{"O", "D", "C [127.0.0.1]", "H client.example.org", "H client.example.org", "D", "M <sender@example.org>"}, received[:7])
+	require.Contains(t, received, "E")
+}
+
+func TestMilterSTARTTLS(t *testing.T) {
+	fake := &fakeMilter{respond: func(cmd byte, data []byte) []milterModification {
+		if cmd == milterMail {
+			return []milterModification{{code: milterReject}}
+		}
+		return nil
+	}}
+
+	addr := startTestServerTLS(t, &ServerConfig{
+		Milters: []*Milter{startFakeMilter(t, fake)},
+		Handler: func(c *Context) error { return nil },
+	})
+
+	c := dialStartTLS(t, addr)
+	code, _ := command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 550, code)
+
+	code, _ = command(t, c, "QUIT")
+	require.Equal(t, 221, code)
+
+	require.Eventually(t, func() bool {
+		received := fake.received()
+		return len(received) > 0 && received[len(received)-1] == "Q"
+	}, time.Second, 10*time.Millisecond)
+
+	// a single milter connection, not quit on STARTTLS
+	require.Equal(t, []string{"O", "D", "C [127.0.0.1]", "H client.example.org", "H client.example.org", "D", "M <sender@example.org>"}, fake.received()[:7])
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := l.Addr().String()
+	l.Close()
+
+	addr := startTestServer(t, &ServerConfig{
+		Milters: []*Milter{{Network: "tcp", Address: unreachable}},
+		Handler: func(c *Context) error { return nil },
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 451, code)
+
+	addr = startTestServer(t, &ServerConfig{
+		Milters: []*Milter{{Network: "tcp", Address: unreachable, FailOpen: true}},
+		Handler: func(c *Context) error { return nil },
+	})
+
+	code, _ = sendTestMessage(t, addr, "recipient@example.com")
+	require.Equal(t, 250, code)
+}
+
+func TestParseMilterReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  *smtp.SMTPError
+	}{
+		{reply: "550 5.7.1 Spam detected\x00", want: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Spam detected"}},
+		{reply: "451 Try later", want: &smtp.SMTPError{Code: 451, EnhancedCode: smtp.NoEnhancedCode, Message: "Try later"}},
+		{reply: "550-5.7.1 Line one\r\n550 5.7.1 Line two", want: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Line one Line two"}},
+		{reply: "250 OK", want: ErrMilterReject},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, parseMilterReply([]byte(tt.reply)))
+	}
+}
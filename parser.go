@@ -75,6 +75,23 @@ func ParseEmail(r io.Reader) (email *Email, err error) {
 	return
 }
 
+// ParseHeader parses only the header block of an email message read from io.Reader, the body is left unread
+func ParseHeader(r io.Reader) (email *Email, err error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return
+	}
+
+	email, err = createEmailFromHeader(msg.Header)
+	if err != nil {
+		return
+	}
+
+	email.ContentType = msg.Header.Get("Content-Type")
+
+	return
+}
+
 func createEmailFromHeader(header mail.Header) (email *Email, err error) {
 	hp := headerParser{header: &header}
 
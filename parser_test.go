@@ -213,3 +213,22 @@ func TestParseEmail(t *testing.T) {
 		})
 	}
 }
+
+func TestParseHeader(t *testing.T) {
+	input := "From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: =?ISO-8859-1?q?Caf=E9?=\r\n" +
+		"Message-ID: <id@example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=unterminated\r\n" +
+		"\r\n" +
+		"--unterminated\r\n"
+
+	email, err := ParseHeader(bytes.NewReader([]byte(input)))
+
+	require.NoError(t, err)
+	require.Equal(t, "Café", email.Subject)
+	require.Equal(t, "id@example.com", email.MessageID)
+	require.Equal(t, []*mail.Address{{Name: "", Address: "recipient@example.com"}}, email.To)
+	require.Equal(t, "multipart/mixed; boundary=unterminated", email.ContentType)
+	require.Empty(t, email.Attachments)
+}
@@ -0,0 +1,325 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultPolicyTimeout bounds a policy request when PolicyService.Timeout is zero, as in Postfix.
+const DefaultPolicyTimeout = 100 * time.Second
+
+var (
+	// ErrPolicyUnavailable is replied when the policy service fails and isn't FailOpen.
+	ErrPolicyUnavailable = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Server configuration problem",
+	}
+
+	// ErrPolicyAction is replied to an action the policy service shouldn't answer.
+	ErrPolicyAction = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 5},
+		Message:      "Server configuration error",
+	}
+)
+
+// policyTLSVersions names the TLS versions as Postfix does in encryption_protocol.
+var policyTLSVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// policyMaxIdle bounds the idle connections kept to a policy service.
+const policyMaxIdle = 4
+
+// PolicyService is a Postfix SMTP access policy delegation server, e.g. a quota or rate limit service.
+// Use RcptPolicy as a RcptPolicy and Middleware for the end of DATA, connections are reused.
+type PolicyService struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout bounds each request, it defaults to DefaultPolicyTimeout.
+	Timeout time.Duration
+	// FailOpen accepts when the service is unreachable or fails, instead of a 451.
+	FailOpen bool
+
+	once sync.Once
+	idle chan *policyConn
+}
+
+type policyConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// RcptPolicy asks the service about a recipient, with protocol_state=RCPT.
+func (p *PolicyService) RcptPolicy(c *Context, to *mail.Address) error {
+	return p.check(c, "RCPT", to)
+}
+
+// Middleware asks the service about the message, with protocol_state=END-OF-MESSAGE.
+func (p *PolicyService) Middleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		if err := p.check(c, "END-OF-MESSAGE", nil); err != nil {
+			return err
+		}
+
+		if c.session.transaction().discard {
+			return nil
+		}
+
+		return next(c)
+	}
+}
+
+func (p *PolicyService) check(c *Context, state string, to *mail.Address) error {
+	action, err := p.query(policyAttributes(c, state, to))
+	if err != nil {
+		c.session.logger().Printf("policy service %s: %v", p.Address, err)
+		if p.FailOpen {
+			return nil
+		}
+
+		return ErrPolicyUnavailable
+	}
+
+	return policyAction(c, action)
+}
+
+// policyAttributes describes the transaction, as Postfix does in the order of its documentation.
+func policyAttributes(c *Context, state string, to *mail.Address) [][2]string {
+	s := c.session
+
+	var from, recipient string
+	if c.From() != nil {
+		from = c.From().Address
+	}
+
+	count := len(s.recipients)
+	if to != nil {
+		recipient = to.Address
+	} else if count == 1 {
+		recipient = s.recipients[0].Address
+	}
+
+	var clientAddress string
+	if ip := c.RemoteIP(); ip != nil {
+		clientAddress = ip.String()
+	}
+
+	clientName := "unknown"
+	if s.rdns != nil && s.rdns.Status == RDNSPass {
+		clientName = s.rdns.Hostname
+	}
+
+	// the SIZE parameter until the message is received
+	var size int64
+	if tx := s.tx; tx != nil && tx.body != nil {
+		size = tx.body.Size()
+	} else if tx != nil {
+		size = tx.size
+	}
+
+	attrs := [][2]string{
+		{"request", "smtpd_access_policy"},
+		{"protocol_state", state},
+		{"protocol_name", "ESMTP"},
+		{"helo_name", c.Helo()},
+		{"queue_id", c.QueueID()},
+		{"sender", from},
+		{"recipient", recipient},
+		{"recipient_count", strconv.Itoa(count)},
+		{"client_address", clientAddress},
+		{"client_name", clientName},
+		{"instance", c.QueueID()},
+	}
+
+	if s.username != nil {
+		attrs = append(attrs, [2]string{"sasl_method", "PLAIN"}, [2]string{"sasl_username", *s.username})
+	}
+
+	attrs = append(attrs, [2]string{"size", strconv.FormatInt(size, 10)})
+
+	if state := c.TLS(); state != nil {
+		attrs = append(attrs,
+			[2]string{"encryption_protocol", policyTLSVersions[state.Version]},
+			[2]string{"encryption_cipher", tls.CipherSuiteName(state.CipherSuite)})
+	}
+
+	return attrs
+}
+
+// policyAction maps a policy action to a reply, see access(5).
+func policyAction(c *Context, action string) error {
+	verb, text := action, ""
+	if i := strings.IndexAny(action, " \t"); i >= 0 {
+		verb, text = action[:i], strings.TrimSpace(action[i+1:])
+	}
+
+	switch strings.ToUpper(verb) {
+	case "PREPEND":
+		return prependPolicyField(c, text)
+	case "OK", "DUNNO", "FILTER", "REDIRECT", "BCC", "DEFER_IF_REJECT", "":
+		// nothing rejects after the policies, so DEFER_IF_REJECT never defers
+		return nil
+	case "REJECT":
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: orDefault(text, "Access denied")}
+	case "DEFER", "DEFER_IF_PERMIT":
+		return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: orDefault(text, "Service unavailable")}
+	case "HOLD":
+		c.TxMeta().Set(MetaQuarantine, "policy: "+orDefault(text, "hold"))
+		return nil
+	case "DISCARD":
+		c.session.transaction().discard = true
+		return nil
+	case "WARN", "INFO":
+		c.session.logger().Printf("policy service %s: %s", c.QueueID(), text)
+		return nil
+	}
+
+	if code, err := strconv.Atoi(verb); err == nil && code >= 400 && code <= 599 {
+		return parseMilterReply([]byte(action))
+	}
+
+	c.session.logger().Printf("policy service: unknown action %q", action)
+
+	return ErrPolicyAction
+}
+
+// prependPolicyField adds the header field of a PREPEND action, at once at the end of the message,
+// otherwise once it's received.
+func prependPolicyField(c *Context, field string) error {
+	if i := strings.IndexByte(field, ':'); i < 1 || strings.ContainsAny(field[:i], " \t") {
+		c.session.logger().Printf("policy service: malformed PREPEND %q", field)
+		return ErrPolicyAction
+	}
+
+	tx := c.session.transaction()
+	if tx.body == nil {
+		tx.prepend = append(tx.prepend, field+"\r\n")
+		return nil
+	}
+
+	return c.session.prependFields([]string{field + "\r\n"})
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+
+	return s
+}
+
+// query sends the attributes and returns the action, on a reused connection when possible.
+// A reused connection may have been closed by the service meanwhile, the request is then sent again
+// unless it timed out, the Timeout bounding the whole query.
+func (p *PolicyService) query(attrs [][2]string) (string, error) {
+	var request strings.Builder
+	for _, attr := range attrs {
+		// the protocol is line based, values can't span lines
+		value := strings.NewReplacer("\r", "", "\n", "").Replace(attr[1])
+		fmt.Fprintf(&request, "%s=%s\n", attr[0], value)
+	}
+	request.WriteString("\n")
+
+	deadline := time.Now().Add(p.timeout())
+	for {
+		conn, reused, err := p.conn()
+		if err != nil {
+			return "", err
+		}
+
+		action, err := p.exchange(conn, request.String(), deadline)
+		if err != nil {
+			conn.Close()
+			if netErr, ok := err.(net.Error); reused && !(ok && netErr.Timeout()) {
+				continue
+			}
+
+			return "", err
+		}
+
+		p.release(conn)
+
+		return action, nil
+	}
+}
+
+// exchange sends a request and reads the attributes of the reply until the empty line.
+func (p *PolicyService) exchange(conn *policyConn, request string, deadline time.Time) (string, error) {
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return "", err
+	}
+
+	var action string
+	for {
+		line, err := conn.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return action, nil
+		}
+
+		if strings.HasPrefix(line, "action=") {
+			action = strings.TrimPrefix(line, "action=")
+		}
+	}
+}
+
+func (p *PolicyService) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return DefaultPolicyTimeout
+	}
+
+	return p.Timeout
+}
+
+func (p *PolicyService) pool() chan *policyConn {
+	p.once.Do(func() {
+		p.idle = make(chan *policyConn, policyMaxIdle)
+	})
+
+	return p.idle
+}
+
+// conn returns an idle connection, or a new one, and whether it was reused.
+func (p *PolicyService) conn() (*policyConn, bool, error) {
+	select {
+	case conn := <-p.pool():
+		return conn, true, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout(p.Network, p.Address, p.timeout())
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &policyConn{Conn: conn, r: bufio.NewReader(conn)}, false, nil
+}
+
+func (p *PolicyService) release(conn *policyConn) {
+	select {
+	case p.pool() <- conn:
+	default:
+		conn.Close()
+	}
+}
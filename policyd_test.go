@@ -0,0 +1,242 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakePolicyService answers the requests with the action of decide and records them.
+func startFakePolicyService(t *testing.T, decide func(attrs map[string]string) string) (*PolicyService, func() []map[string]string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var requests []map[string]string
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				attrs := map[string]string{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					line = strings.TrimSuffix(line, "\n")
+					if line != "" {
+						kv := strings.SplitN(line, "=", 2)
+						attrs[kv[0]] = kv[1]
+						continue
+					}
+
+					mu.Lock()
+					requests = append(requests, attrs)
+					mu.Unlock()
+
+					fmt.Fprintf(conn, "action=%s\n\n", decide(attrs))
+					attrs = map[string]string{}
+				}
+			}()
+		}
+	}()
+
+	return &PolicyService{Network: "tcp", Address: l.Addr().String()}, func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]map[string]string{}, requests...)
+	}
+}
+
+func TestPolicyAction(t *testing.T) {
+	tests := []struct {
+		action     string
+		want       error
+		quarantine string
+		discard    bool
+	}{
+		{action: "DUNNO"},
+		{action: "OK"},
+		{action: "REJECT", want: &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Access denied"}},
+		{action: "REJECT Over quota", want: &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Over quota"}},
+		{action: "defer Rate limited", want: &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Rate limited"}},
+		{action: "DEFER_IF_PERMIT", want: &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Service unavailable"}},
+		{action: "452 4.2.2 Mailbox full", want: &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}},
+		{action: "HOLD suspicious", quarantine: "policy: suspicious"},
+		{action: "DISCARD", discard: true},
+		{action: "PREPEND malformed", want: ErrPolicyAction},
+		{action: "BOGUS", want: ErrPolicyAction},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			s := NewSession(nil, nil)
+			s.config = &ServerConfig{Logger: &testLogger{}}
+			c := &Context{session: s}
+
+			require.Equal(t, tt.want, policyAction(c, tt.action))
+			require.Equal(t, tt.quarantine, c.TxMeta().GetString(MetaQuarantine))
+			require.Equal(t, tt.discard, s.transaction().discard)
+		})
+	}
+}
+
+func TestPolicyService(t *testing.T) {
+	policy, requests := startFakePolicyService(t, func(attrs map[string]string) string {
+		if attrs["recipient"] == "full@example.com" {
+			return "552 5.2.2 Mailbox full"
+		}
+
+		if attrs["protocol_state"] == "END-OF-MESSAGE" && attrs["size"] != "0" {
+			return "DEFER Too many messages"
+		}
+
+		return "DUNNO"
+	})
+
+	addr := startTestServer(t, &ServerConfig{
+		RcptPolicies: []RcptPolicy{policy.RcptPolicy},
+		Middlewares:  []Middleware{policy.Middleware},
+		Handler:      func(c *Context) error { return nil },
+	})
+
+	code, msg := sendTestMessage(t, addr, "recipient@example.com", "full@example.com")
+	require.Equal(t, 552, code)
+	require.Equal(t, "5.2.2 Mailbox full", msg)
+
+	code, msg = sendTestMessage(t, addr, "recipient@example.com")
+	require.Equal(t, 450, code)
+	require.Equal(t, "4.7.1 Too many messages", msg)
+
+	all := requests()
+	require.Len(t, all, 4)
+
+	rcpt := all[0]
+	require.Equal(t, "smtpd_access_policy", rcpt["request"])
+	require.Equal(t, "RCPT", rcpt["protocol_state"])
+	require.Equal(t, "client.example.org", rcpt["helo_name"])
+	require.Equal(t, "sender@example.org", rcpt["sender"])
+	require.Equal(t, "recipient@example.com", rcpt["recipient"])
+	require.Equal(t, "0", rcpt["recipient_count"])
+	require.Equal(t, "127.0.0.1", rcpt["client_address"])
+	require.Len(t, rcpt["queue_id"], 12)
+
+	eom := all[3]
+	require.Equal(t, "END-OF-MESSAGE", eom["protocol_state"])
+	require.Equal(t, "recipient@example.com", eom["recipient"])
+	require.Equal(t, "1", eom["recipient_count"])
+	require.Equal(t, "35", eom["size"])
+}
+
+func TestPolicyServiceSizeAndPrepend(t *testing.T) {
+	policy, requests := startFakePolicyService(t, func(attrs map[string]string) string {
+		return "PREPEND X-Policy: " + strings.ToLower(attrs["protocol_state"])
+	})
+
+	received := make(chan string, 1)
+	addr := startTestServer(t, &ServerConfig{
+		RcptPolicies: []RcptPolicy{policy.RcptPolicy},
+		Middlewares:  []Middleware{policy.Middleware},
+		Handler: func(c *Context) error {
+			body, err := ioutil.ReadAll(c.Body())
+			received <- string(body)
+			return err
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org> SIZE=1234")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+	code, _ = command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	all := requests()
+	require.Len(t, all, 2)
+	require.Equal(t, "1234", all[0]["size"])
+	require.Equal(t, "39", all[1]["size"])
+	require.Equal(t, "X-Policy: end-of-message\r\nX-Policy: rcpt\r\nSubject: test\r\n\r\nbody\r\n", <-received)
+}
+
+func TestPolicyServiceReconnect(t *testing.T) {
+	policy, requests := startFakePolicyService(t, func(attrs map[string]string) string { return "DUNNO" })
+
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{Logger: &testLogger{}}
+	c := &Context{session: s}
+
+	require.NoError(t, policy.check(c, "RCPT", nil))
+
+	// the service dropped the idle connection
+	conn := <-policy.pool()
+	conn.Close()
+	policy.pool() <- conn
+
+	require.NoError(t, policy.check(c, "RCPT", nil))
+	require.Len(t, requests(), 2)
+}
+
+func TestPolicyServiceUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := l.Addr().String()
+	l.Close()
+
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{Logger: &testLogger{}}
+	c := &Context{session: s}
+
+	require.Equal(t, ErrPolicyUnavailable, (&PolicyService{Network: "tcp", Address: unreachable}).check(c, "RCPT", nil))
+	require.NoError(t, (&PolicyService{Network: "tcp", Address: unreachable, FailOpen: true}).check(c, "RCPT", nil))
+}
+
+func TestPolicyServiceTimeout(t *testing.T) {
+	var calls int32
+	policy, requests := startFakePolicyService(t, func(attrs map[string]string) string {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return "DUNNO"
+	})
+	policy.Timeout = 100 * time.Millisecond
+
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{Logger: &testLogger{}}
+	c := &Context{session: s}
+
+	require.NoError(t, policy.check(c, "RCPT", nil))
+
+	// the reused connection times out, the request isn't sent again
+	start := time.Now()
+	require.Equal(t, ErrPolicyUnavailable, policy.check(c, "RCPT", nil))
+	require.Less(t, time.Since(start), 200*time.Millisecond)
+	require.Len(t, requests(), 2)
+}
@@ -0,0 +1,135 @@
+package smtpsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RDNSStatus is the outcome of a forward-confirmed reverse DNS check, as the iprev method of RFC 8601.
+type RDNSStatus string
+
+const (
+	// RDNSPass means a PTR name of the client resolves back to its IP.
+	RDNSPass RDNSStatus = "pass"
+	// RDNSFail means none of the PTR names resolves back to the client IP.
+	RDNSFail RDNSStatus = "fail"
+	// RDNSNone means the client IP has no PTR record.
+	RDNSNone RDNSStatus = "none"
+	// RDNSTemperror is a DNS failure, the check may succeed later.
+	RDNSTemperror RDNSStatus = "temperror"
+)
+
+// maxPTRNames bounds the forward lookups of a client with many PTR names.
+const maxPTRNames = 10
+
+// RDNSResult is the outcome of an FCrDNS check.
+type RDNSResult struct {
+	Status RDNSStatus
+	// Hostname is the forward-confirmed name, only set on pass.
+	Hostname string
+	// Names are the PTR names of the client, without the trailing dot.
+	Names []string
+	// HeloMatch tells whether the HELO name is the forward-confirmed name.
+	HeloMatch bool
+	Err       error
+}
+
+// CheckFCrDNS looks up the PTR names of ip and confirms one of them resolves back to ip.
+func CheckFCrDNS(ctx context.Context, resolver Resolver, ip net.IP) *RDNSResult {
+	result := &RDNSResult{}
+	if ip == nil {
+		result.Status, result.Err = RDNSNone, fmt.Errorf("rdns: unknown client ip")
+		return result
+	}
+
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		result.Status = RDNSTemperror
+		if isNotFound(err) {
+			result.Status = RDNSNone
+		}
+
+		result.Err = err
+		return result
+	}
+
+	for _, name := range names {
+		result.Names = append(result.Names, normalizeName(name))
+	}
+
+	result.Status = RDNSFail
+	for i, name := range result.Names {
+		if i == maxPTRNames {
+			break
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			if !isNotFound(err) {
+				result.Status, result.Err = RDNSTemperror, err
+			}
+
+			continue
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				result.Status, result.Hostname, result.Err = RDNSPass, name, nil
+				return result
+			}
+		}
+	}
+
+	return result
+}
+
+// FCrDNS checks the reverse DNS of the client once per connection, and compares it to the HELO name.
+func (c Context) FCrDNS() *RDNSResult {
+	s := c.session
+	if s.rdns == nil {
+		ctx, cancel := s.lookupContext()
+		defer cancel()
+
+		s.rdns = CheckFCrDNS(ctx, s.resolver(), c.RemoteIP())
+		s.rdns.HeloMatch = s.rdns.Hostname != "" && normalizeName(c.Helo()) == s.rdns.Hostname
+	}
+
+	return s.rdns
+}
+
+// Received returns the Received header of the message as in RFC 5321 section 4.4, ready to be prepended.
+// The client is named by its forward-confirmed hostname, or "unknown", after its HELO name.
+func (c Context) Received() string {
+	hostname := "unknown"
+	if rdns := c.FCrDNS(); rdns.Status == RDNSPass {
+		hostname = rdns.Hostname
+	}
+
+	var ip string
+	if remoteIP := c.RemoteIP(); remoteIP != nil {
+		ip = remoteIP.String()
+		if remoteIP.To4() == nil {
+			ip = "IPv6:" + ip
+		}
+	}
+
+	// protocol types of RFC 3848
+	protocol := "ESMTP"
+	if c.TLS() != nil {
+		protocol += "S"
+	}
+	if c.session.authenticated {
+		protocol += "A"
+	}
+
+	header := fmt.Sprintf("Received: from %s (%s [%s])\r\n\tby %s with %s id %s",
+		c.Helo(), hostname, ip, c.session.config.BannerDomain, protocol, c.QueueID())
+
+	if recipients := c.Recipients(); len(recipients) == 1 {
+		header += "\r\n\tfor <" + recipients[0].Address + ">"
+	}
+
+	return header + "; " + time.Now().Format(time.RFC1123Z) + "\r\n"
+}
@@ -0,0 +1,132 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testRDNSRecords = &FakeResolver{
+	PTR: map[string][]string{
+		"192.0.2.1":   {"mail.example.org."},
+		"192.0.2.2":   {"forged.example.org.", "other.example.org."},
+		"192.0.2.3":   {"broken.example.org."},
+		"127.0.0.1":   {"localhost."},
+		"2001:db8::1": {"mail6.example.org."},
+	},
+	IP: map[string][]net.IP{
+		"mail.example.org":   {net.ParseIP("192.0.2.1")},
+		"mail6.example.org":  {net.ParseIP("2001:db8::1")},
+		"forged.example.org": {net.ParseIP("198.51.100.1")},
+		"localhost":          {net.ParseIP("127.0.0.1")},
+	},
+	Errors: map[string]error{
+		"broken.example.org": &net.DNSError{Err: "server misbehaving", IsTemporary: true},
+	},
+}
+
+func TestCheckFCrDNS(t *testing.T) {
+	tests := []struct {
+		ip       string
+		status   RDNSStatus
+		hostname string
+	}{
+		{ip: "192.0.2.1", status: RDNSPass, hostname: "mail.example.org"},
+		{ip: "2001:db8::1", status: RDNSPass, hostname: "mail6.example.org"},
+		{ip: "192.0.2.2", status: RDNSFail},
+		{ip: "192.0.2.3", status: RDNSTemperror},
+		{ip: "192.0.2.4", status: RDNSNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			result := CheckFCrDNS(context.Background(), testRDNSRecords, net.ParseIP(tt.ip))
+
+			require.Equal(t, tt.status, result.Status)
+			require.Equal(t, tt.hostname, result.Hostname)
+		})
+	}
+}
+
+func TestReceived(t *testing.T) {
+	received := make(chan string, 1)
+	rdns := make(chan *RDNSResult, 1)
+
+	addr := startTestServer(t, &ServerConfig{
+		Resolver: testRDNSRecords,
+		Handler: func(c *Context) error {
+			received <- c.Received()
+			rdns <- c.FCrDNS()
+			return nil
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO localhost")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+	code, _ = command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	require.Regexp(t, regexp.MustCompile(`^Received: from localhost \(localhost \[127\.0\.0\.1\]\)\r\n`+
+		`\tby mx\.example\.com with ESMTP id [0-9A-F]{12}\r\n`+
+		`\tfor <recipient@example\.com>; .+ [+-]\d{4}\r\n$`), <-received)
+
+	result := <-rdns
+	require.Equal(t, RDNSPass, result.Status)
+	require.True(t, result.HeloMatch)
+}
+
+// countingResolver counts the reverse lookups.
+type countingResolver struct {
+	Resolver
+	reverse int32
+}
+
+func (r *countingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	atomic.AddInt32(&r.reverse, 1)
+	return r.Resolver.LookupAddr(ctx, addr)
+}
+
+func TestFCrDNSAfterEHLO(t *testing.T) {
+	resolver := &countingResolver{Resolver: testRDNSRecords}
+	rdns := make(chan *RDNSResult, 1)
+
+	addr := startTestServer(t, &ServerConfig{
+		Resolver: resolver,
+		HeloPolicies: []HeloPolicy{
+			func(c *Context, name string) error {
+				c.FCrDNS()
+				return nil
+			},
+		},
+		Handler: func(c *Context) error {
+			rdns <- c.FCrDNS()
+			return nil
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO localhost")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	finishTransaction(t, c)
+
+	result := <-rdns
+	require.Equal(t, RDNSPass, result.Status)
+	require.False(t, result.HeloMatch)
+	require.Equal(t, int32(1), atomic.LoadInt32(&resolver.reverse))
+}
@@ -0,0 +1,192 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDNSTimeout bounds the DNS lookups of a single check when ServerConfig.DNSTimeout is zero.
+const DefaultDNSTimeout = 10 * time.Second
+
+// Resolver performs the DNS lookups of the checks. A *net.Resolver has all the methods but LookupTLSA,
+// see DefaultResolver, NewDNSResolver for a caching implementation and FakeResolver for tests.
+// Missing names or records are reported as a *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupTLSA(ctx context.Context, name string) ([]TLSA, error)
+}
+
+// TLSA is a DANE TLSA record, as in RFC 6698.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	// Certificate is the hex encoded association data.
+	Certificate string
+}
+
+// DefaultResolver uses the system resolver, and the resolv.conf nameservers for TLSA lookups.
+var DefaultResolver Resolver = &netResolver{Resolver: net.DefaultResolver}
+
+// netResolver adds TLSA lookups to a *net.Resolver.
+type netResolver struct {
+	*net.Resolver
+
+	once sync.Once
+	tlsa *DNSResolver
+	err  error
+}
+
+func (r *netResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	r.once.Do(func() {
+		r.tlsa, r.err = NewDNSResolver()
+	})
+
+	if r.err != nil {
+		return nil, &net.DNSError{Err: r.err.Error(), Name: name, IsTemporary: true}
+	}
+
+	return r.tlsa.LookupTLSA(ctx, name)
+}
+
+// isNotFound reports whether err means the name or record doesn't exist, as opposed to a temporary failure.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+
+	return ok && dnsErr.IsNotFound
+}
+
+// errNotFound is the error of a lookup which has no records.
+func errNotFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// normalizeName lowercases name and removes its trailing dot.
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func (cfg *ServerConfig) resolver() Resolver {
+	if cfg.Resolver == nil {
+		return DefaultResolver
+	}
+
+	return cfg.Resolver
+}
+
+// lookupContext bounds the lookups of a check by the DNSTimeout.
+func (cfg *ServerConfig) lookupContext() (context.Context, context.CancelFunc) {
+	timeout := cfg.DNSTimeout
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func (s *Session) resolver() Resolver {
+	return s.config.resolver()
+}
+
+func (s *Session) lookupContext() (context.Context, context.CancelFunc) {
+	return s.config.lookupContext()
+}
+
+// FakeResolver resolves from memory, e.g. in tests. Names are matched case-insensitively without
+// the trailing dot, PTR records are keyed by IP address. Names without records are not found.
+type FakeResolver struct {
+	TXT  map[string][]string
+	MX   map[string][]*net.MX
+	IP   map[string][]net.IP
+	PTR  map[string][]string
+	TLSA map[string][]TLSA
+
+	// Errors are returned by any lookup of the name, e.g. a timeout.
+	Errors map[string]error
+}
+
+func (r *FakeResolver) lookup(name string) (string, error) {
+	name = normalizeName(name)
+	if err, ok := r.Errors[name]; ok {
+		return name, err
+	}
+
+	return name, nil
+}
+
+func (r *FakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if records, ok := r.TXT[name]; ok {
+		return records, nil
+	}
+
+	return nil, errNotFound(name)
+}
+
+func (r *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	name, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if records, ok := r.MX[name]; ok {
+		return records, nil
+	}
+
+	return nil, errNotFound(name)
+}
+
+func (r *FakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host, err := r.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, ok := r.IP[host]
+	if !ok {
+		return nil, errNotFound(host)
+	}
+
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+
+	return addrs, nil
+}
+
+func (r *FakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	addr, err := r.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if names, ok := r.PTR[addr]; ok {
+		return names, nil
+	}
+
+	return nil, errNotFound(addr)
+}
+
+func (r *FakeResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	name, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if records, ok := r.TLSA[name]; ok {
+		return records, nil
+	}
+
+	return nil, errNotFound(name)
+}
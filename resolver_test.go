@@ -0,0 +1,72 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zaccone/spf"
+)
+
+func TestFakeResolver(t *testing.T) {
+	r := &FakeResolver{
+		TXT:    map[string][]string{"example.org": {"v=spf1 -all"}},
+		IP:     map[string][]net.IP{"mx.example.org": {net.ParseIP("192.0.2.1")}},
+		PTR:    map[string][]string{"192.0.2.1": {"mx.example.org."}},
+		Errors: map[string]error{"broken.example.org": &net.DNSError{Err: "server misbehaving", IsTemporary: true}},
+	}
+
+	txts, err := r.LookupTXT(context.Background(), "Example.ORG.")
+	require.NoError(t, err)
+	require.Equal(t, []string{"v=spf1 -all"}, txts)
+
+	addrs, err := r.LookupIPAddr(context.Background(), "mx.example.org")
+	require.NoError(t, err)
+	require.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, addrs)
+
+	names, err := r.LookupAddr(context.Background(), "192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"mx.example.org."}, names)
+
+	_, err = r.LookupMX(context.Background(), "example.org")
+	require.True(t, isNotFound(err))
+
+	_, err = r.LookupTXT(context.Background(), "broken.example.org")
+	require.Error(t, err)
+	require.False(t, isNotFound(err))
+}
+
+func TestCheckSPFWithResolver(t *testing.T) {
+	r := &FakeResolver{
+		TXT: map[string][]string{
+			"example.org": {"v=spf1 mx a:relay.example.org -all"},
+			"example.net": {"v=spf1 include:broken.example.net -all"},
+		},
+		MX: map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+		IP: map[string][]net.IP{
+			"mx.example.org":    {net.ParseIP("192.0.2.1")},
+			"relay.example.org": {net.ParseIP("2001:db8::1")},
+		},
+		Errors: map[string]error{"broken.example.net": &net.DNSError{Err: "i/o timeout", IsTimeout: true}},
+	}
+
+	tests := []struct {
+		ip   string
+		from string
+		want SPFResult
+	}{
+		{ip: "192.0.2.1", from: "sender@example.org", want: spf.Pass},
+		{ip: "2001:db8::1", from: "sender@example.org", want: spf.Pass},
+		{ip: "192.0.2.2", from: "sender@example.org", want: spf.Fail},
+		{ip: "192.0.2.1", from: "sender@example.com", want: spf.None},
+		{ip: "192.0.2.1", from: "sender@example.net", want: spf.Temperror},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip+" "+tt.from, func(t *testing.T) {
+			check := checkSPF(context.Background(), r, net.ParseIP(tt.ip), "client.example.org", tt.from)
+			require.Equal(t, tt.want, check.result)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package smtpsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultRspamdTimeout bounds a check when Rspamd.Timeout is zero.
+const DefaultRspamdTimeout = 20 * time.Second
+
+// rspamd actions
+const (
+	RspamdNoAction       = "no action"
+	RspamdGreylist       = "greylist"
+	RspamdAddHeader      = "add header"
+	RspamdRewriteSubject = "rewrite subject"
+	RspamdSoftReject     = "soft reject"
+	RspamdReject         = "reject"
+)
+
+var (
+	// ErrRspamdReject is replied to the messages rspamd rejects, unless it gives its own message.
+	ErrRspamdReject = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Spam message rejected",
+	}
+
+	// ErrRspamdSoftReject is replied to the messages rspamd soft rejects or greylists.
+	ErrRspamdSoftReject = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Try again later",
+	}
+
+	// ErrRspamdFailed is replied when rspamd fails and the checker isn't FailOpen.
+	ErrRspamdFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Spam check failed, try again later",
+	}
+)
+
+// RspamdSymbol is a rule which matched the message.
+type RspamdSymbol struct {
+	Name        string   `json:"name"`
+	Score       float64  `json:"score"`
+	Description string   `json:"description"`
+	Options     []string `json:"options"`
+}
+
+// RspamdResult is the verdict of rspamd on a message.
+type RspamdResult struct {
+	Score         float64                 `json:"score"`
+	RequiredScore float64                 `json:"required_score"`
+	Action        string                  `json:"action"`
+	Symbols       map[string]RspamdSymbol `json:"symbols"`
+	// Messages may hold the "smtp_message" to reply.
+	Messages map[string]string `json:"messages"`
+	// Subject is the new subject of the rewrite subject action.
+	Subject string `json:"subject"`
+	Skipped bool   `json:"is_skipped"`
+}
+
+// Rspamd checks messages with the rspamd HTTP protocol, see Check and Middleware.
+type Rspamd struct {
+	// URL of the normal worker, e.g. http://127.0.0.1:11333.
+	URL string
+	// Password is sent when set, as the controller expects it.
+	Password string
+	// Client defaults to an http.Client with the Timeout.
+	Client *http.Client
+	// Timeout bounds a check, it defaults to DefaultRspamdTimeout.
+	Timeout time.Duration
+	// FailOpen accepts messages when rspamd fails, instead of a 451.
+	FailOpen bool
+}
+
+// Check posts the message to /checkv2 with the envelope from Context, once per transaction.
+// The verdict is also on Context.Rspamd.
+func (r *Rspamd) Check(c *Context) (*RspamdResult, error) {
+	tx := c.session.tx
+	if tx == nil || tx.body == nil {
+		return nil, errors.New("rspamd: no message body")
+	}
+	if tx.rspamd != nil {
+		return tx.rspamd, nil
+	}
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultRspamdTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(r.URL, "/")+"/checkv2", c.Body())
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = tx.body.Size()
+
+	if ip := c.RemoteIP(); ip != nil {
+		req.Header.Set("IP", ip.String())
+	}
+	if helo := c.Helo(); helo != "" {
+		req.Header.Set("Helo", helo)
+	}
+	if c.From() != nil {
+		req.Header.Set("From", c.From().Address)
+	}
+	for _, to := range c.Recipients() {
+		req.Header.Add("Rcpt", to.Address)
+	}
+	if c.session.username != nil {
+		req.Header.Set("User", *c.session.username)
+	}
+	if rdns := c.session.rdns; rdns != nil && rdns.Status == RDNSPass {
+		req.Header.Set("Hostname", rdns.Hostname)
+	}
+	req.Header.Set("Queue-Id", c.QueueID())
+	if r.Password != "" {
+		req.Header.Set("Password", r.Password)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: timeout}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd: %s", resp.Status)
+	}
+
+	result := &RspamdResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("rspamd: %v", err)
+	}
+
+	tx.rspamd = result
+
+	return result, nil
+}
+
+// Middleware checks the message before the handler and applies the action: reject and soft reject
+// (or greylist) are replied, add header adds X-Spam headers and rewrite subject also changes the Subject.
+func (r *Rspamd) Middleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		result, err := r.Check(c)
+		if err != nil {
+			c.session.logger().Printf("rspamd check of %s: %v", c.QueueID(), err)
+			if r.FailOpen {
+				return next(c)
+			}
+
+			return ErrRspamdFailed
+		}
+
+		switch result.Action {
+		case RspamdReject:
+			if msg := result.Messages["smtp_message"]; msg != "" {
+				return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: msg}
+			}
+
+			return ErrRspamdReject
+		case RspamdSoftReject, RspamdGreylist:
+			return ErrRspamdSoftReject
+		case RspamdAddHeader, RspamdRewriteSubject:
+			var subject string
+			if result.Action == RspamdRewriteSubject {
+				subject = result.Subject
+			}
+
+			if err := c.session.markSpam(result.Score, result.RequiredScore, subject); err != nil {
+				return err
+			}
+		}
+
+		return next(c)
+	}
+}
+
+// markSpam adds the X-Spam headers to the message, and replaces its subject when not empty.
+func (s *Session) markSpam(score, required float64, subject string) error {
+	fields, body, err := readRawHeader(s.transaction().body.Reader())
+	if err != nil {
+		return err
+	}
+
+	if subject != "" {
+		fields = changeMilterField(fields, "Subject", 1, subject)
+	}
+
+	fields = append([]string{
+		"X-Spam: Yes\r\n",
+		fmt.Sprintf("X-Spam-Score: %.2f / %.2f\r\n", score, required),
+	}, fields...)
+
+	return s.rewriteMessage(fields, body)
+}
+
+// Rspamd returns the verdict of rspamd, nil when the message wasn't checked.
+func (c Context) Rspamd() *RspamdResult {
+	if c.session.tx == nil {
+		return nil
+	}
+
+	return c.session.tx.rspamd
+}
@@ -0,0 +1,154 @@
+package smtpsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rspamdRequest is a request received by the fake rspamd.
+type rspamdRequest struct {
+	header http.Header
+	body   string
+}
+
+// startFakeRspamd answers /checkv2 with the result and records the last request.
+func startFakeRspamd(t *testing.T, result *RspamdResult) (*Rspamd, chan rspamdRequest) {
+	t.Helper()
+
+	requests := make(chan rspamdRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- rspamdRequest{header: r.Header, body: string(body)}
+
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(server.Close)
+
+	return &Rspamd{URL: server.URL}, requests
+}
+
+func TestRspamd(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *RspamdResult
+		code   int
+		msg    string
+		body   string
+	}{
+		{name: "no action", result: &RspamdResult{Action: RspamdNoAction, Score: 1.5, RequiredScore: 15}, code: 250, body: "Subject: test\r\nX-Spam: no\r\n\r\nbody\r\n"},
+		{name: "reject", result: &RspamdResult{Action: RspamdReject}, code: 554, msg: "5.7.1 Spam message rejected"},
+		{name: "reject with message", result: &RspamdResult{Action: RspamdReject, Messages: map[string]string{"smtp_message": "Go away"}}, code: 554, msg: "5.7.1 Go away"},
+		{name: "soft reject", result: &RspamdResult{Action: RspamdSoftReject}, code: 451, msg: "4.7.1 Try again later"},
+		{name: "greylist", result: &RspamdResult{Action: RspamdGreylist}, code: 451, msg: "4.7.1 Try again later"},
+		{
+			name:   "add header",
+			result: &RspamdResult{Action: RspamdAddHeader, Score: 7.25, RequiredScore: 15},
+			code:   250,
+			body:   "X-Spam: Yes\r\nX-Spam-Score: 7.25 / 15.00\r\nSubject: test\r\nX-Spam: no\r\n\r\nbody\r\n",
+		},
+		{
+			name:   "rewrite subject",
+			result: &RspamdResult{Action: RspamdRewriteSubject, Score: 9, RequiredScore: 15, Subject: "[SPAM] test"},
+			code:   250,
+			body:   "X-Spam: Yes\r\nX-Spam-Score: 9.00 / 15.00\r\nSubject: [SPAM] test\r\nX-Spam: no\r\n\r\nbody\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rspamd, _ := startFakeRspamd(t, tt.result)
+
+			handled := make(chan string, 1)
+			addr := startTestServer(t, &ServerConfig{
+				Middlewares: []Middleware{rspamd.Middleware},
+				Handler: func(c *Context) error {
+					require.Equal(t, tt.result.Action, c.Rspamd().Action)
+
+					body, err := ioutil.ReadAll(c.Body())
+					handled <- string(body)
+					return err
+				},
+			})
+
+			code, msg := sendTestMessage(t, addr, "recipient@example.com")
+			require.Equal(t, tt.code, code)
+			require.True(t, strings.HasPrefix(msg, tt.msg), msg)
+
+			if tt.body != "" {
+				require.Equal(t, tt.body, <-handled)
+			} else {
+				require.Len(t, handled, 0)
+			}
+		})
+	}
+}
+
+func TestRspamdRequest(t *testing.T) {
+	rspamd, requests := startFakeRspamd(t, &RspamdResult{
+		Action:  RspamdNoAction,
+		Score:   -0.1,
+		Symbols: map[string]RspamdSymbol{"MIME_GOOD": {Name: "MIME_GOOD", Score: -0.1, Options: []string{"text/plain"}}},
+	})
+
+	addr := startTestServer(t, &ServerConfig{
+		Middlewares: []Middleware{rspamd.Middleware},
+		Handler: func(c *Context) error {
+			require.Equal(t, -0.1, c.Rspamd().Symbols["MIME_GOOD"].Score)
+			return nil
+		},
+	})
+
+	code, _ := sendTestMessage(t, addr, "recipient@example.com", "other@example.com")
+	require.Equal(t, 250, code)
+
+	r := <-requests
+	require.Equal(t, "127.0.0.1", r.header.Get("IP"))
+	require.Equal(t, "client.example.org", r.header.Get("Helo"))
+	require.Equal(t, "sender@example.org", r.header.Get("From"))
+	require.Equal(t, []string{"recipient@example.com", "other@example.com"}, r.header["Rcpt"])
+	require.Len(t, r.header.Get("Queue-Id"), 12)
+	require.Empty(t, r.header.Get("User"))
+	require.Equal(t, "Subject: test\r\nX-Spam: no\r\n\r\nbody\r\n", r.body)
+}
+
+func TestRspamdUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	addr := startTestServer(t, &ServerConfig{
+		Middlewares: []Middleware{(&Rspamd{URL: server.URL}).Middleware},
+		Handler:     func(c *Context) error { return nil },
+	})
+
+	code, _ := sendTestMessage(t, addr, "recipient@example.com")
+	require.Equal(t, 451, code)
+
+	addr = startTestServer(t, &ServerConfig{
+		Middlewares: []Middleware{(&Rspamd{URL: server.URL, FailOpen: true}).Middleware},
+		Handler:     func(c *Context) error { return nil },
+	})
+
+	code, _ = sendTestMessage(t, addr, "recipient@example.com")
+	require.Equal(t, 250, code)
+}
+
+func TestRspamdNoBody(t *testing.T) {
+	rspamd, requests := startFakeRspamd(t, &RspamdResult{Action: RspamdNoAction})
+
+	_, err := rspamd.Check(&Context{session: NewSession(nil, nil)})
+	require.EqualError(t, err, "rspamd: no message body")
+	require.Len(t, requests, 0)
+}
@@ -0,0 +1,350 @@
+package smtpsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrScoreReject is replied to the messages scoring at least the reject threshold.
+var ErrScoreReject = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected as spam",
+}
+
+// ScoreRule types
+const (
+	// ScoreHeader matches Pattern against the values of Header.
+	ScoreHeader = "header"
+	// ScoreBody matches Pattern, or any of the case insensitive Phrases, against the text and HTML bodies.
+	ScoreBody = "body"
+	// ScoreURL matches Pattern against the URLs of the bodies.
+	ScoreURL = "url"
+	// ScoreAttachment matches Pattern against the attachment filenames and content types.
+	ScoreAttachment = "attachment"
+	// ScoreMissingHeader matches when Header is missing, e.g. Message-ID or Date.
+	ScoreMissingHeader = "missing-header"
+	// ScoreFromMismatch matches when the envelope sender domain isn't aligned with the From domain.
+	ScoreFromMismatch = "from-mismatch"
+	// ScoreToMismatch matches when none of the envelope recipients is in To or Cc.
+	ScoreToMismatch = "to-mismatch"
+)
+
+// ScoreAction is the decision of a Scorer.
+type ScoreAction string
+
+const (
+	ScoreAccept ScoreAction = "accept"
+	ScoreTag    ScoreAction = "tag"
+	ScoreReject ScoreAction = "reject"
+)
+
+// scoreURLPattern finds the URLs of the bodies, HTML attributes included.
+var scoreURLPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s"'<>()]+`)
+
+// ScoreRule adds its Score to the messages it matches.
+type ScoreRule struct {
+	// Name identifies the rule in the report, e.g. SUBJECT_ALL_CAPS.
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Type        string  `json:"type"`
+	Score       float64 `json:"score"`
+	Header      string  `json:"header,omitempty"`
+	// Pattern is a regular expression, use (?i) for case insensitive matches.
+	Pattern string   `json:"pattern,omitempty"`
+	Phrases []string `json:"phrases,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// ScoreMatch is a rule which matched the message.
+type ScoreMatch struct {
+	Rule        string
+	Description string
+	Score       float64
+	// Detail is the matched text.
+	Detail string
+}
+
+// ScoreResult is the verdict of a Scorer, see Report.
+type ScoreResult struct {
+	Score   float64
+	Action  ScoreAction
+	Matches []ScoreMatch
+
+	tag, reject float64
+}
+
+// Report explains the score rule by rule, in the order of the rules.
+func (r *ScoreResult) Report() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Score %.1f (tag at %.1f, reject at %.1f): %s\n", r.Score, r.tag, r.reject, r.Action)
+
+	for _, match := range r.Matches {
+		fmt.Fprintf(&b, "%5.1f %-24s %s", match.Score, match.Rule, match.Description)
+		if match.Detail != "" {
+			fmt.Fprintf(&b, " [%s]", match.Detail)
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// Scorer is an embedded content filter adding the scores of the rules which match a message.
+// Use LoadScorer to read it from a JSON file, and Middleware to act on the verdict.
+type Scorer struct {
+	Rules []*ScoreRule `json:"rules"`
+	// TagThreshold is the score from which messages get the X-Spam headers, zero disables tagging.
+	TagThreshold float64 `json:"tag_threshold"`
+	// RejectThreshold is the score from which messages are rejected, zero disables rejecting.
+	RejectThreshold float64 `json:"reject_threshold"`
+
+	once sync.Once
+	err  error
+}
+
+// LoadScorer reads a Scorer from a JSON file, e.g.
+//
+//	{
+//	  "tag_threshold": 5,
+//	  "reject_threshold": 10,
+//	  "rules": [
+//	    {"name": "MISSING_MID", "type": "missing-header", "header": "Message-ID", "score": 1.5},
+//	    {"name": "SUBJECT_OFFER", "type": "header", "header": "Subject", "pattern": "(?i)special offer", "score": 3}
+//	  ]
+//	}
+func LoadScorer(path string) (*Scorer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scorer{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := s.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return s, nil
+}
+
+// compile validates the rules and compiles their patterns, once.
+func (s *Scorer) compile() error {
+	s.once.Do(func() {
+		for _, rule := range s.Rules {
+			if s.err = rule.compile(); s.err != nil {
+				return
+			}
+		}
+	})
+
+	return s.err
+}
+
+func (r *ScoreRule) compile() error {
+	switch r.Type {
+	case ScoreHeader, ScoreMissingHeader:
+		if r.Header == "" {
+			return fmt.Errorf("rule %s: no header", r.Name)
+		}
+	case ScoreBody:
+		if r.Pattern == "" && len(r.Phrases) == 0 {
+			return fmt.Errorf("rule %s: no pattern nor phrases", r.Name)
+		}
+	case ScoreURL, ScoreAttachment, ScoreFromMismatch, ScoreToMismatch:
+	default:
+		return fmt.Errorf("rule %s: unknown type %q", r.Name, r.Type)
+	}
+
+	if r.Pattern == "" {
+		if r.Type == ScoreHeader || r.Type == ScoreURL || r.Type == ScoreAttachment {
+			return fmt.Errorf("rule %s: no pattern", r.Name)
+		}
+
+		return nil
+	}
+
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.Name, err)
+	}
+	r.re = re
+
+	return nil
+}
+
+// Check scores the message once per transaction, the verdict is also on Context.Score.
+func (s *Scorer) Check(c *Context) (*ScoreResult, error) {
+	tx := c.session.transaction()
+	if tx.score != nil {
+		return tx.score, nil
+	}
+
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+
+	email, err := c.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ScoreResult{Action: ScoreAccept, tag: s.TagThreshold, reject: s.RejectThreshold}
+	for _, rule := range s.Rules {
+		if detail, ok := rule.match(c, email); ok {
+			result.Score += rule.Score
+			result.Matches = append(result.Matches, ScoreMatch{
+				Rule:        rule.Name,
+				Description: rule.Description,
+				Score:       rule.Score,
+				Detail:      detail,
+			})
+		}
+	}
+
+	switch {
+	case s.RejectThreshold != 0 && result.Score >= s.RejectThreshold:
+		result.Action = ScoreReject
+	case s.TagThreshold != 0 && result.Score >= s.TagThreshold:
+		result.Action = ScoreTag
+	}
+
+	tx.score = result
+
+	return result, nil
+}
+
+// match returns whether the rule matches the message, and the matched text.
+func (r *ScoreRule) match(c *Context, email *Email) (string, bool) {
+	switch r.Type {
+	case ScoreHeader:
+		name := textproto.CanonicalMIMEHeaderKey(r.Header)
+		for _, value := range email.Header[name] {
+			if r.re.MatchString(value) {
+				return name + ": " + value, true
+			}
+		}
+	case ScoreMissingHeader:
+		name := textproto.CanonicalMIMEHeaderKey(r.Header)
+		return "", len(email.Header[name]) == 0
+	case ScoreBody:
+		for _, body := range []string{email.TextBody, email.HTMLBody} {
+			if r.re != nil {
+				if found := r.re.FindString(body); found != "" {
+					return found, true
+				}
+			}
+
+			lower := strings.ToLower(body)
+			for _, phrase := range r.Phrases {
+				if strings.Contains(lower, strings.ToLower(phrase)) {
+					return phrase, true
+				}
+			}
+		}
+	case ScoreURL:
+		for _, body := range []string{email.TextBody, email.HTMLBody} {
+			for _, url := range scoreURLPattern.FindAllString(body, -1) {
+				if r.re.MatchString(url) {
+					return url, true
+				}
+			}
+		}
+	case ScoreAttachment:
+		for _, attachment := range email.Attachments {
+			if r.re.MatchString(attachment.Filename) || r.re.MatchString(attachment.ContentType) {
+				return attachment.Filename, true
+			}
+		}
+	case ScoreFromMismatch:
+		return fromMismatch(c, email)
+	case ScoreToMismatch:
+		return toMismatch(c, email)
+	}
+
+	return "", false
+}
+
+// fromMismatch matches when the envelope sender domain isn't aligned with any From domain, in relaxed mode.
+// The null sender doesn't match.
+func fromMismatch(c *Context, email *Email) (string, bool) {
+	if c.From() == nil || c.From().Address == "" || len(email.From) == 0 {
+		return "", false
+	}
+
+	_, domain, err := SplitAddress(c.From().Address)
+	if err != nil {
+		return "", false
+	}
+
+	for _, from := range email.From {
+		_, fromDomain, err := SplitAddress(from.Address)
+		if err == nil && aligned(domain, fromDomain, false) {
+			return "", false
+		}
+	}
+
+	return c.From().Address + " vs " + email.From[0].Address, true
+}
+
+// toMismatch matches when no envelope recipient is in To or Cc, as when they're all Bcc or the header is forged.
+func toMismatch(c *Context, email *Email) (string, bool) {
+	recipients := c.Recipients()
+	if len(recipients) == 0 {
+		return "", false
+	}
+
+	for _, to := range recipients {
+		for _, address := range append(append([]*mail.Address{}, email.To...), email.Cc...) {
+			if strings.EqualFold(to.Address, address.Address) {
+				return "", false
+			}
+		}
+	}
+
+	return recipients[0].Address, true
+}
+
+// Middleware scores the message before the handler, rejects it from the reject threshold and adds
+// the X-Spam headers from the tag threshold. Messages which can't be parsed aren't scored.
+func (s *Scorer) Middleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		result, err := s.Check(c)
+		if err != nil {
+			c.session.logger().Printf("scoring of %s: %v", c.QueueID(), err)
+			return next(c)
+		}
+
+		switch result.Action {
+		case ScoreReject:
+			return ErrScoreReject
+		case ScoreTag:
+			if err := c.session.markSpam(result.Score, s.TagThreshold, ""); err != nil {
+				return err
+			}
+		}
+
+		return next(c)
+	}
+}
+
+// Score returns the verdict of the Scorer, nil when the message wasn't scored.
+func (c Context) Score() *ScoreResult {
+	if c.session.tx == nil {
+		return nil
+	}
+
+	return c.session.tx.score
+}
@@ -0,0 +1,150 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testScorerConfig = `{
+  "tag_threshold": 3,
+  "reject_threshold": 8,
+  "rules": [
+    {"name": "SUBJECT_OFFER", "description": "Subject advertises an offer", "type": "header", "header": "subject", "pattern": "(?i)special offer", "score": 2},
+    {"name": "MISSING_MID", "description": "No Message-ID", "type": "missing-header", "header": "Message-ID", "score": 1},
+    {"name": "MISSING_DATE", "description": "No Date", "type": "missing-header", "header": "Date", "score": 1},
+    {"name": "BODY_PRIZE", "description": "Talks about a prize", "type": "body", "phrases": ["you have won", "claim your prize"], "score": 2.5},
+    {"name": "URL_SHORTENER", "description": "Links to a URL shortener", "type": "url", "pattern": "^https?://(bit\\.ly|tinyurl\\.com)/", "score": 1.5},
+    {"name": "FROM_MISMATCH", "description": "Envelope and header senders differ", "type": "from-mismatch", "score": 0.5},
+    {"name": "TO_MISMATCH", "description": "No envelope recipient in To or Cc", "type": "to-mismatch", "score": 0.5}
+  ]
+}`
+
+func loadTestScorer(t *testing.T) *Scorer {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testScorerConfig), 0600))
+
+	scorer, err := LoadScorer(path)
+	require.NoError(t, err)
+
+	return scorer
+}
+
+func TestScorer(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		action  ScoreAction
+		score   float64
+		rules   []string
+	}{
+		{
+			name:    "ham",
+			message: "From: sender@example.org\nTo: recipient@example.com\nDate: Mon, 2 Jan 2006 15:04:05 -0700\nMessage-ID: <1@example.org>\nSubject: hello\n\nSee https://example.org/\n",
+			action:  ScoreAccept,
+		},
+		{
+			name:    "tagged",
+			message: "From: sender@example.org\nTo: recipient@example.com\nSubject: Special offer\n\nhello\n",
+			action:  ScoreTag,
+			score:   4,
+			rules:   []string{"SUBJECT_OFFER", "MISSING_MID", "MISSING_DATE"},
+		},
+		{
+			name:    "rejected",
+			message: "From: winner@lottery.example\nTo: someone@example.net\nSubject: SPECIAL OFFER\n\nYou have WON, see https://bit.ly/abc\n",
+			action:  ScoreReject,
+			score:   9,
+			rules:   []string{"SUBJECT_OFFER", "MISSING_MID", "MISSING_DATE", "BODY_PRIZE", "URL_SHORTENER", "FROM_MISMATCH", "TO_MISMATCH"},
+		},
+	}
+
+	scorer := loadTestScorer(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, &ServerConfig{}, tt.message)
+			c.session.From = &mail.Address{Address: "sender@example.org"}
+			c.session.recipients = []*mail.Address{{Address: "recipient@example.com"}}
+
+			result, err := scorer.Check(c)
+			require.NoError(t, err)
+			require.Equal(t, tt.action, result.Action)
+			require.InDelta(t, tt.score, result.Score, 0.001)
+
+			var rules []string
+			for _, match := range result.Matches {
+				rules = append(rules, match.Rule)
+			}
+			require.Equal(t, tt.rules, rules)
+			require.Same(t, result, c.Score())
+		})
+	}
+}
+
+func TestScoreReport(t *testing.T) {
+	c := newTestContext(t, &ServerConfig{}, "From: sender@example.org\nSubject: Special offer\n\nhello\n")
+	c.session.From = &mail.Address{Address: "sender@example.org"}
+
+	result, err := loadTestScorer(t).Check(c)
+	require.NoError(t, err)
+	require.Equal(t, "Score 4.0 (tag at 3.0, reject at 8.0): tag\n"+
+		"  2.0 SUBJECT_OFFER            Subject advertises an offer [Subject: Special offer]\n"+
+		"  1.0 MISSING_MID              No Message-ID\n"+
+		"  1.0 MISSING_DATE             No Date\n", result.Report())
+}
+
+func TestLoadScorerInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown type":  `{"rules": [{"name": "X", "type": "magic"}]}`,
+		"no header":     `{"rules": [{"name": "X", "type": "header", "pattern": "x"}]}`,
+		"no pattern":    `{"rules": [{"name": "X", "type": "url"}]}`,
+		"bad pattern":   `{"rules": [{"name": "X", "type": "body", "pattern": "("}]}`,
+		"invalid json":  `{"rules": [`,
+		"empty phrases": `{"rules": [{"name": "X", "type": "body"}]}`,
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+
+			_, err := LoadScorer(path)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestScorerMiddleware(t *testing.T) {
+	scorer := &Scorer{
+		TagThreshold:    1,
+		RejectThreshold: 5,
+		Rules: []*ScoreRule{
+			{Name: "SUBJECT_TEST", Type: ScoreHeader, Header: "Subject", Pattern: "^test$", Score: 1.5},
+		},
+	}
+
+	handled := make(chan string, 1)
+	addr := startTestServer(t, &ServerConfig{
+		Middlewares: []Middleware{scorer.Middleware},
+		Handler: func(c *Context) error {
+			body, err := ioutil.ReadAll(c.Body())
+			handled <- string(body)
+			return err
+		},
+	})
+
+	code, _ := sendTestMessage(t, addr, "recipient@example.com")
+	require.Equal(t, 250, code)
+	require.Equal(t, "X-Spam: Yes\r\nX-Spam-Score: 1.50 / 1.00\r\nSubject: test\r\nX-Spam: no\r\n\r\nbody\r\n", <-handled)
+
+	scorer.Rules[0].Score = 6
+	code, msg := sendTestMessage(t, addr, "recipient@example.com")
+	require.Equal(t, 554, code)
+	require.Equal(t, "5.7.1 Message rejected as spam", msg)
+}
@@ -3,6 +3,7 @@ package smtpsrv
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -17,14 +18,72 @@ type ServerConfig struct {
 	Auther          AuthFunc
 	MaxMessageBytes int64
 	TLSConfig       *tls.Config
+
+	// SpoolThreshold is the message size above which DATA is spooled to a temp file in SpoolDir,
+	// it defaults to DefaultSpoolThreshold and the system temp dir.
+	SpoolThreshold int64
+	SpoolDir       string
+
+	// StripAuthResults removes the incoming Authentication-Results header fields claiming the BannerDomain
+	// as authserv-id before the Handler runs, as only this server may add them.
+	StripAuthResults bool
+
+	// BareLineEndings is what DATA does with a CR or LF not part of a CRLF, against SMTP smuggling.
+	// Messages are accepted as received by default, Context.BareLineEndings tells about them.
+	BareLineEndings BareLineEndingPolicy
+
+	// GreetDelay holds the greeting back, clients talking meanwhile are early talkers as spambots not waiting
+	// for it. Zero disables it. Pipelining before EHLO is always detected, see Context.Pregreet and
+	// Context.IllegalPipelining. RejectEarlyTalkers rejects both instead of only recording them.
+	GreetDelay         time.Duration
+	RejectEarlyTalkers bool
+
+	// OnConnect is called before the greeting, returning an error rejects the client with a 554 greeting.
+	OnConnect func(remoteAddr net.Addr) error
+
+	// DNSBL checks the client IP against blocklists before the greeting, see DNSBLChecker.
+	DNSBL *DNSBLChecker
+
+	// HeloPolicies run in order on HELO/EHLO, e.g. StrictHelo, the first error is replied.
+	HeloPolicies []HeloPolicy
+
+	// MailPolicies and RcptPolicies run in order on MAIL FROM and RCPT TO, the first error is replied.
+	MailPolicies []MailPolicy
+	RcptPolicies []RcptPolicy
+
+	// Tarpit delays the RCPT replies to suspicious clients and disconnects directory harvesters.
+	Tarpit *Tarpit
+
+	// OnTransactionStart is called once MAIL FROM is accepted, OnTransactionEnd on RSET, after DATA,
+	// on a new MAIL FROM or on disconnect. OnDisconnect is called when the client leaves.
+	OnTransactionStart func(c *Context)
+	OnTransactionEnd   func(c *Context)
+	OnDisconnect       func(c *Context)
+
+	// Resolver is used by the DNS based checks, it defaults to DefaultResolver.
+	// DNSTimeout bounds the lookups of each check, it defaults to DefaultDNSTimeout.
+	Resolver   Resolver
+	DNSTimeout time.Duration
+
+	// Milters are spoken to along the session, in order, their actions and modifications apply
+	// before the Middlewares and Handler run.
+	Milters []*Milter
+
+	// Middlewares wrap the Handler, the first one being the outermost.
+	Middlewares []Middleware
+
+	// Logger defaults to stderr, Metrics to a no-op.
+	Logger  Logger
+	Metrics Metrics
 }
 
 type Server struct {
 	*smtp.Server
+	config *ServerConfig
 }
 
 func NewServer(cfg *ServerConfig) *Server {
-	s := smtp.NewServer(NewBackend(cfg.Auther, cfg.Handler))
+	s := smtp.NewServer(newBackend(cfg))
 
 	s.Addr = cfg.ListenAddr
 	s.Domain = cfg.BannerDomain
@@ -35,11 +94,15 @@ func NewServer(cfg *ServerConfig) *Server {
 	s.AuthDisabled = true
 	s.EnableSMTPUTF8 = false
 
-	return &Server{s}
+	if cfg.Logger != nil {
+		s.ErrorLog = cfg.Logger
+	}
+
+	return &Server{Server: s, config: cfg}
 }
 
 func NewServerTLS(cfg *ServerConfig) *Server {
-	s := smtp.NewServer(NewBackend(cfg.Auther, cfg.Handler))
+	s := smtp.NewServer(newBackend(cfg))
 
 	s.Addr = cfg.ListenAddr
 	s.Domain = cfg.BannerDomain
@@ -52,19 +115,48 @@ func NewServerTLS(cfg *ServerConfig) *Server {
 	s.EnableREQUIRETLS = true
 	s.TLSConfig = cfg.TLSConfig
 
-	return &Server{s}
+	if cfg.Logger != nil {
+		s.ErrorLog = cfg.Logger
+	}
+
+	return &Server{Server: s, config: cfg}
 
 }
 func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":smtp"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("⇨ smtp server started on", s.Addr)
-	return s.Server.ListenAndServe()
+	return s.Serve(l)
 
 }
 
 func (s *Server) ListenAndServeTLS() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":smtps"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("⇨ smtp server started on", s.Addr)
-	return s.Server.ListenAndServeTLS()
+	return s.Server.Serve(tls.NewListener(&listener{Listener: l, config: s.config, tls: true}, s.TLSConfig))
+
+}
 
+// Serve accepts the connections of l, running the connect hooks of the config on each of them.
+func (s *Server) Serve(l net.Listener) error {
+	return s.Server.Serve(&listener{Listener: l, config: s.config})
 }
 
 func (s *Server) Close() error {
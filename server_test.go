@@ -0,0 +1,190 @@
+package smtpsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer serves cfg on a random local port until the test ends.
+func startTestServer(t *testing.T, cfg *ServerConfig) string {
+	t.Helper()
+
+	return serveTestServer(t, cfg, NewServer)
+}
+
+// startTestServerTLS is startTestServer with STARTTLS, using a self-signed certificate.
+func startTestServerTLS(t *testing.T, cfg *ServerConfig) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	return serveTestServer(t, cfg, NewServerTLS)
+}
+
+func serveTestServer(t *testing.T, cfg *ServerConfig, newServer func(cfg *ServerConfig) *Server) string {
+	t.Helper()
+
+	cfg.BannerDomain = "mx.example.com"
+	cfg.ReadTimeout = 2 * time.Second
+	cfg.WriteTimeout = 2 * time.Second
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := newServer(cfg)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Server.Close() })
+
+	return l.Addr().String()
+}
+
+// dialStartTLS connects to addr, sends EHLO and STARTTLS, and returns the connection once encrypted.
+func dialStartTLS(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+
+	c := textproto.NewConn(nc)
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+	code, _ := command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "STARTTLS")
+	require.Equal(t, 220, code)
+
+	tc := tls.Client(nc, &tls.Config{ServerName: "mx.example.com", InsecureSkipVerify: true})
+	require.NoError(t, tc.Handshake())
+
+	return textproto.NewConn(tc)
+}
+
+// dialTestServer connects to addr and reads the greeting.
+func dialTestServer(t *testing.T, addr string) (*textproto.Conn, int, string) {
+	t.Helper()
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	code, msg, _ := c.ReadResponse(0)
+
+	return c, code, msg
+}
+
+// command sends a command and returns the reply.
+func command(t *testing.T, c *textproto.Conn, format string, args ...interface{}) (int, string) {
+	t.Helper()
+
+	id, err := c.Cmd(format, args...)
+	require.NoError(t, err)
+
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+
+	code, msg, _ := c.ReadResponse(0)
+
+	return code, msg
+}
+
+func TestOnConnect(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		Handler: func(c *Context) error { return nil },
+		OnConnect: func(remoteAddr net.Addr) error {
+			return errors.New("blocklisted " + remoteAddr.(*net.TCPAddr).IP.String())
+		},
+	})
+
+	_, code, msg := dialTestServer(t, addr)
+
+	require.Equal(t, 554, code)
+	require.Equal(t, "5.7.1 blocklisted 127.0.0.1", msg)
+}
+
+func TestHelo(t *testing.T) {
+	helo := make(chan string, 1)
+
+	addr := startTestServer(t, &ServerConfig{
+		HeloPolicies: []HeloPolicy{StrictHelo},
+		Handler: func(c *Context) error {
+			helo <- c.Helo()
+			return nil
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = command(t, c, "EHLO 192.0.2.1")
+	require.Equal(t, 504, code)
+
+	code, _ = command(t, c, "EHLO mx.example.com")
+	require.Equal(t, 550, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "DATA")
+	require.Equal(t, 354, code)
+	code, _ = command(t, c, "Subject: test\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	require.Equal(t, "client.example.org", <-helo)
+}
+
+func TestStrictHelo(t *testing.T) {
+	tests := []struct {
+		helo string
+		want error
+	}{
+		{helo: "client.example.org", want: nil},
+		{helo: "[192.0.2.1]", want: nil},
+		{helo: "[IPv6:2001:db8::1]", want: nil},
+		{helo: "192.0.2.1", want: ErrHeloInvalid},
+		{helo: "[not-an-ip]", want: ErrHeloInvalid},
+		{helo: "localhost", want: ErrHeloInvalid},
+		{helo: "-bad.example.org", want: ErrHeloInvalid},
+		{helo: "under_score.example.org", want: ErrHeloInvalid},
+		{helo: "1.2.3.4.5", want: ErrHeloInvalid},
+		{helo: "MX.example.com.", want: ErrHeloForged},
+	}
+
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{BannerDomain: "mx.example.com"}
+
+	for _, tt := range tests {
+		t.Run(tt.helo, func(t *testing.T) {
+			require.Equal(t, tt.want, StrictHelo(&Context{session: s}, tt.helo))
+		})
+	}
+}
@@ -3,63 +3,254 @@ package smtpsrv
 import (
 	"errors"
 	"io"
+	"net"
 	"net/mail"
+	"runtime/debug"
 
 	"github.com/emersion/go-smtp"
 )
 
 // A Session is returned after successful login.
 type Session struct {
-	conn     *smtp.Conn
-	From     *mail.Address
-	To       *mail.Address
-	handler  HandlerFunc
-	body     io.Reader
-	username *string
-	password *string
+	conn       *smtp.Conn
+	config     *ServerConfig
+	helo       string
+	dnsbl      *DNSBLResult
+	rdns       *RDNSResult
+	milters    []*milterClient
+	From       *mail.Address
+	To         *mail.Address
+	recipients []*mail.Address
+	handler    HandlerFunc
+	auther     AuthFunc
+	tx         *transaction
+	username   *string
+	password   *string
+	// authenticated is set once the Auther accepted the username and password.
+	authenticated bool
+	meta          Metadata
+	txMeta        Metadata
+
+	// pregreet and pipelining record the early talker checks of the connection,
+	// bareLineEndings is set once the client sent a message with a bare CR or LF.
+	pregreet        bool
+	pipelining      bool
+	bareLineEndings bool
+	// rejectedRcpts counts the invalid recipients rejected on the connection, for the Tarpit.
+	rejectedRcpts int
+	// done is closed with the connection, nil when there is none.
+	done <-chan struct{}
 }
 
 // NewSession initialize a new session
 func NewSession(conn *smtp.Conn, handler HandlerFunc) *Session {
 	return &Session{
 		conn:    conn,
+		config:  &ServerConfig{},
 		handler: handler,
 	}
 }
 
-func (s *Session) AuthPlain(username, password string) (err error) {
+// AuthPlain checks the username and password with the Auther, there is no authentication without one.
+func (s *Session) AuthPlain(username, password string) error {
 	s.username = &username
 	s.password = &password
-	return
+	s.authenticated = false
+
+	if s.auther == nil {
+		return ErrAuthDisabled
+	}
+
+	if err := s.auther(username, password); err != nil {
+		return err
+	}
+
+	s.authenticated = true
+
+	return nil
 }
 
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
-	s.To, err = mail.ParseAddress(to)
-	return
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return s.tarpit(s.rcpt(to))
+}
+
+func (s *Session) rcpt(to string) error {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+
+	c := Context{session: s}
+	for _, policy := range s.config.RcptPolicies {
+		if err := policy(&c, addr); err != nil {
+			return err
+		}
+	}
+
+	if err := s.milterDiscard(s.milterRcpt(addr)); err != nil {
+		return err
+	}
+
+	s.To = addr
+	s.recipients = append(s.recipients, addr)
+
+	return nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
-	s.From, err = mail.ParseAddress(from)
+	// a second MAIL FROM without RSET starts over
+	if s.tx != nil {
+		s.Reset()
+	}
+
+	// the null sender of bounces is kept as an empty address
+	if from == "" {
+		s.From = &mail.Address{}
+	} else if s.From, err = mail.ParseAddress(from); err != nil {
+		return
+	}
+
+	if tx := s.transaction(); opts != nil {
+		tx.size = opts.Size
+	}
+
+	c := Context{session: s}
+	for _, policy := range s.config.MailPolicies {
+		if err = policy(&c, s.From); err != nil {
+			s.Reset()
+			return
+		}
+	}
+
+	if err = s.milterDiscard(s.milterMail(s.From)); err != nil {
+		s.Reset()
+		return
+	}
+
+	s.startTransaction()
+
 	return
 }
 
-func (s *Session) Data(r io.Reader) error {
+func (s *Session) Data(r io.Reader) (err error) {
 	if s.handler == nil {
 		return errors.New("internal error: no handler")
 	}
 
-	s.body = r
+	s.startTransaction()
+
+	tx := s.transaction()
+	tx.body = newSpool(s.config.SpoolDir, s.config.SpoolThreshold)
+
+	w := &lineEndingWriter{w: tx.body, normalize: s.config.BareLineEndings == BareLineEndingsNormalize}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if w.bare {
+		s.bareLineEndings = true
+		s.logger().Printf("bare CR or LF in message %s from %v", tx.id, s.remoteAddr())
+
+		if s.config.BareLineEndings == BareLineEndingsReject {
+			return ErrBareLineEnding
+		}
+	}
+
+	if s.config.StripAuthResults && s.config.BannerDomain != "" {
+		if err := s.stripAuthResults(); err != nil {
+			return err
+		}
+	}
+
+	if len(tx.prepend) > 0 {
+		if err := s.prependFields(tx.prepend); err != nil {
+			return err
+		}
+	}
+
+	if err := s.milterDiscard(s.milterData()); err != nil {
+		return err
+	}
+
+	if tx.discard {
+		return nil
+	}
 
 	c := Context{
 		session: s,
 	}
 
-	return s.handler(&c)
+	// a panicking handler must not drop the connection, the client should retry instead
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger().Printf("panic in handler serving %v: %v\n%s", s.remoteAddr(), v, debug.Stack())
+			s.metrics().Inc(MetricHandlerPanics)
+			err = ErrHandlerPanic
+		}
+	}()
+
+	return chain(s.handler, s.config.Middlewares)(&c)
 }
 
+// Reset ends the current transaction and clears its envelope, body and TxMeta.
 func (s *Session) Reset() {
+	s.milterAbort()
+	s.endTransaction()
+
+	s.From = nil
+	s.To = nil
+	s.recipients = nil
+	s.txMeta.clear()
+}
+
+// Meta holds values for the whole connection.
+func (s *Session) Meta() *Metadata {
+	return &s.meta
+}
+
+// TxMeta holds values for the current transaction, it is cleared on Reset.
+func (s *Session) TxMeta() *Metadata {
+	return &s.txMeta
 }
 
+// Logout ends the session on QUIT or disconnect, but also on STARTTLS: the milters are then kept for
+// the session of the next EHLO, they are quit and OnDisconnect is called when the connection closes.
 func (s *Session) Logout() error {
+	s.Reset()
+
+	if s.done != nil {
+		return nil
+	}
+
+	s.milterQuit()
+
+	if s.config.OnDisconnect != nil {
+		s.config.OnDisconnect(&Context{session: s})
+	}
+
 	return nil
 }
+
+func (s *Session) logger() Logger {
+	return s.config.logger()
+}
+
+func (s *Session) metrics() Metrics {
+	if s.config.Metrics == nil {
+		return nopMetrics{}
+	}
+
+	return s.config.Metrics
+}
+
+func (s *Session) remoteAddr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Conn().RemoteAddr()
+}
@@ -0,0 +1,214 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Println(v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintln(v...))
+}
+
+type testMetrics map[string]int
+
+func (m testMetrics) Inc(name string) {
+	m[name]++
+}
+
+func TestSessionDataRecoversPanic(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     HandlerFunc
+		middlewares []Middleware
+	}{
+		{
+			name: "Panic in handler",
+			handler: func(c *Context) error {
+				var email *Email
+				_ = email.Subject
+				return nil
+			},
+		},
+		{
+			name:    "Panic in middleware",
+			handler: func(c *Context) error { return nil },
+			middlewares: []Middleware{
+				func(next HandlerFunc) HandlerFunc {
+					return func(c *Context) error {
+						panic("middleware failure")
+					}
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, metrics := &testLogger{}, testMetrics{}
+
+			s := NewSession(nil, tt.handler)
+			s.config = &ServerConfig{Middlewares: tt.middlewares, Logger: logger, Metrics: metrics}
+
+			err := s.Data(strings.NewReader("Subject: test\r\n\r\nbody"))
+
+			require.Equal(t, ErrHandlerPanic, err)
+			require.Equal(t, 1, metrics[MetricHandlerPanics])
+			require.Len(t, logger.lines, 1)
+			require.Contains(t, logger.lines[0], "goroutine")
+		})
+	}
+}
+
+func TestSessionMetadata(t *testing.T) {
+	var seen []string
+
+	s := NewSession(nil, func(c *Context) error {
+		seen = append(seen, c.Meta().GetString("client"), c.TxMeta().GetString("sender"))
+		return nil
+	})
+	s.config = &ServerConfig{
+		MailPolicies: []MailPolicy{
+			func(c *Context, from *mail.Address) error {
+				c.Meta().Set("client", "trusted")
+				c.TxMeta().Set("sender", from.Address)
+				return nil
+			},
+		},
+		RcptPolicies: []RcptPolicy{
+			func(c *Context, to *mail.Address) error {
+				require.Equal(t, "sender@example.com", c.TxMeta().GetString("sender"))
+				return nil
+			},
+		},
+	}
+
+	require.NoError(t, s.Mail("sender@example.com", nil))
+	require.NoError(t, s.Rcpt("recipient@example.com", nil))
+	require.NoError(t, s.Data(strings.NewReader("Subject: test\r\n\r\nbody")))
+	require.Equal(t, []string{"trusted", "sender@example.com"}, seen)
+
+	s.Reset()
+
+	_, ok := s.TxMeta().Get("sender")
+	require.False(t, ok)
+	require.Equal(t, "trusted", s.Meta().GetString("client"))
+}
+
+func TestSessionMetadataAfterEHLO(t *testing.T) {
+	delivered := make(chan string, 1)
+	addr := startTestServer(t, &ServerConfig{
+		MailPolicies: []MailPolicy{
+			func(c *Context, from *mail.Address) error {
+				if from.Address == "first@example.org" {
+					c.Meta().Set("client", "trusted")
+				}
+				return nil
+			},
+		},
+		Handler: func(c *Context) error {
+			delivered <- c.Meta().GetString("client")
+			return nil
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<first@example.org>")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "RSET")
+	require.Equal(t, 250, code)
+
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	finishTransaction(t, c)
+	require.Equal(t, "trusted", <-delivered)
+}
+
+func TestSessionTransactionLifecycle(t *testing.T) {
+	var events, ids []string
+
+	s := NewSession(nil, func(c *Context) error {
+		events = append(events, "data:"+c.From().Address)
+		return nil
+	})
+	s.config = &ServerConfig{
+		OnTransactionStart: func(c *Context) {
+			events = append(events, "start:"+c.From().Address)
+			ids = append(ids, c.QueueID())
+		},
+		OnTransactionEnd: func(c *Context) {
+			events = append(events, "end:"+c.From().Address)
+		},
+		OnDisconnect: func(c *Context) {
+			events = append(events, "disconnect")
+		},
+	}
+
+	require.NoError(t, s.Mail("first@example.com", nil))
+	require.NoError(t, s.Rcpt("recipient@example.com", nil))
+	s.Reset()
+	require.Nil(t, s.From)
+	require.Nil(t, s.To)
+
+	require.NoError(t, s.Mail("second@example.com", nil))
+	require.NoError(t, s.Mail("third@example.com", nil))
+	require.NoError(t, s.Rcpt("recipient@example.com", nil))
+	require.NoError(t, s.Data(strings.NewReader("Subject: test\r\n\r\nbody")))
+	require.NoError(t, s.Logout())
+
+	require.Equal(t, []string{
+		"start:first@example.com", "end:first@example.com",
+		"start:second@example.com", "end:second@example.com",
+		"start:third@example.com", "data:third@example.com", "end:third@example.com",
+		"disconnect",
+	}, events)
+	require.Len(t, ids, 3)
+	require.NotEqual(t, ids[0], ids[1])
+	require.NotEqual(t, ids[1], ids[2])
+}
+
+func TestSessionHooksSTARTTLS(t *testing.T) {
+	var connects, disconnects int32
+
+	addr := startTestServerTLS(t, &ServerConfig{
+		OnConnect: func(remoteAddr net.Addr) error {
+			atomic.AddInt32(&connects, 1)
+			return nil
+		},
+		OnDisconnect: func(c *Context) {
+			atomic.AddInt32(&disconnects, 1)
+		},
+		Handler: func(c *Context) error { return nil },
+	})
+
+	c := dialStartTLS(t, addr)
+	code, _ := command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	finishTransaction(t, c)
+	require.Equal(t, int32(0), atomic.LoadInt32(&disconnects))
+
+	code, _ = command(t, c, "QUIT")
+	require.Equal(t, 221, code)
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&disconnects) > 0 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&connects))
+	require.Equal(t, int32(1), atomic.LoadInt32(&disconnects))
+}
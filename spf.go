@@ -0,0 +1,225 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/zaccone/spf"
+)
+
+var (
+	// ErrSPFFail is replied by SPFPolicy when the client isn't allowed to send for the domain.
+	ErrSPFFail = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+		Message:      "SPF validation failed",
+	}
+
+	// ErrSPFTemperror is replied by SPFPolicy when the SPF record couldn't be fetched.
+	ErrSPFTemperror = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 24},
+		Message:      "SPF validation error, try again later",
+	}
+)
+
+// spfCheck is the outcome of an SPF evaluation, it is cached on the transaction.
+type spfCheck struct {
+	result      SPFResult
+	explanation string
+	err         error
+
+	// identity is either "mailfrom" or "helo" (for the null sender), as in Received-SPF.
+	identity string
+	sender   string
+	domain   string
+	ip       net.IP
+	helo     string
+}
+
+// checkSPF evaluates SPF for the MAIL FROM identity, or for the HELO identity
+// with the null sender as in RFC 7208 section 2.4.
+func checkSPF(ctx context.Context, resolver Resolver, ip net.IP, helo, from string) *spfCheck {
+	check := &spfCheck{
+		identity: "mailfrom",
+		sender:   from,
+		ip:       ip,
+		helo:     helo,
+	}
+
+	if from == "" {
+		check.identity = "helo"
+		check.sender = "postmaster@" + helo
+
+		// an address literal or a bare name has no SPF record, RFC 7208 section 2.3
+		if net.ParseIP(helo) != nil || !isFQDN(helo) {
+			check.result = spf.None
+			return check
+		}
+	}
+
+	_, check.domain, check.err = SplitAddress(check.sender)
+	if check.err != nil {
+		check.result = spf.None
+		return check
+	}
+
+	if ip == nil {
+		check.result, check.err = spf.None, errors.New("spf: unknown client ip")
+		return check
+	}
+
+	// RFC 7208 section 4.6.4 limits the mechanisms and MX names needing a lookup to 10
+	limited := spf.NewLimitedResolver(&spfResolver{ctx: ctx, resolver: resolver}, 10, 10)
+	check.result, check.explanation, check.err = spf.CheckHostWithResolver(ip, check.domain, check.sender, limited)
+
+	return check
+}
+
+// header formats the Received-SPF header as in RFC 7208 section 9.1, receiver being our hostname.
+func (check *spfCheck) header(receiver string) string {
+	var comment string
+	switch check.result {
+	case spf.Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", check.sender, check.ip)
+	case spf.Fail, spf.Softfail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", check.sender, check.ip)
+	case spf.Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", check.ip, check.sender)
+	case spf.Temperror, spf.Permerror:
+		comment = fmt.Sprintf("error in processing during lookup of %s: %v", check.sender, check.err)
+	default:
+		comment = fmt.Sprintf("domain of %s does not provide an SPF record", check.sender)
+	}
+
+	fields := []string{"receiver=" + receiver}
+	if check.ip != nil {
+		fields = append(fields, "client-ip="+check.ip.String())
+	}
+	fields = append(fields,
+		fmt.Sprintf("envelope-from=%q", check.sender),
+		"helo="+check.helo,
+		"identity="+check.identity,
+	)
+
+	return fmt.Sprintf("Received-SPF: %s (%s: %s) %s;", check.result, receiver, comment, strings.Join(fields, "; "))
+}
+
+// spf evaluates SPF once per transaction.
+func (c Context) spf() *spfCheck {
+	tx := c.session.transaction()
+	if tx.spf == nil {
+		var from string
+		if c.From() != nil {
+			from = c.From().Address
+		}
+
+		ctx, cancel := c.session.lookupContext()
+		defer cancel()
+
+		tx.spf = checkSPF(ctx, c.session.resolver(), c.RemoteIP(), c.Helo(), from)
+	}
+
+	return tx.spf
+}
+
+// ReceivedSPF returns the Received-SPF header of the SPF evaluation, ready to be prepended to the message.
+func (c Context) ReceivedSPF() string {
+	return c.spf().header(c.session.config.BannerDomain)
+}
+
+// SPFPolicy is a MailPolicy evaluating SPF on MAIL FROM, it rejects a fail result
+// and defers a temperror one. The result is available later through Context.SPF.
+func SPFPolicy(c *Context, from *mail.Address) error {
+	result, _, _ := c.SPF()
+
+	switch result {
+	case spf.Fail:
+		return ErrSPFFail
+	case spf.Temperror:
+		return ErrSPFTemperror
+	}
+
+	return nil
+}
+
+// spfResolver adapts a Resolver to the SPF library, mapping missing names to its expected errors.
+type spfResolver struct {
+	ctx      context.Context
+	resolver Resolver
+}
+
+// spfError maps a lookup error, RFC 7208 section 5 treats NXDOMAIN as no records.
+func spfError(err error) error {
+	if err == nil || isNotFound(err) {
+		return nil
+	}
+
+	return spf.ErrDNSTemperror
+}
+
+func (r *spfResolver) LookupTXT(name string) ([]string, error) {
+	txts, err := r.resolver.LookupTXT(r.ctx, name)
+	if err != nil {
+		return nil, spfError(err)
+	}
+
+	return txts, nil
+}
+
+func (r *spfResolver) LookupTXTStrict(name string) ([]string, error) {
+	txts, err := r.resolver.LookupTXT(r.ctx, name)
+	if isNotFound(err) {
+		return nil, spf.ErrDNSPermerror
+	}
+
+	if err != nil {
+		return nil, spf.ErrDNSTemperror
+	}
+
+	return txts, nil
+}
+
+func (r *spfResolver) Exists(name string) (bool, error) {
+	addrs, err := r.resolver.LookupIPAddr(r.ctx, name)
+	if err != nil {
+		return false, spfError(err)
+	}
+
+	return len(addrs) > 0, nil
+}
+
+func (r *spfResolver) MatchIP(name string, matcher spf.IPMatcherFunc) (bool, error) {
+	addrs, err := r.resolver.LookupIPAddr(r.ctx, name)
+	if err != nil {
+		return false, spfError(err)
+	}
+
+	for _, addr := range addrs {
+		if m, err := matcher(addr.IP); m || err != nil {
+			return m, err
+		}
+	}
+
+	return false, nil
+}
+
+func (r *spfResolver) MatchMX(name string, matcher spf.IPMatcherFunc) (bool, error) {
+	mxs, err := r.resolver.LookupMX(r.ctx, name)
+	if err != nil {
+		return false, spfError(err)
+	}
+
+	for _, mx := range mxs {
+		if m, err := r.MatchIP(mx.Host, matcher); m || err != nil {
+			return m, err
+		}
+	}
+
+	return false, nil
+}
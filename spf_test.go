@@ -0,0 +1,110 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zaccone/spf"
+)
+
+func TestSPFHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		check *spfCheck
+		want  string
+	}{
+		{
+			name: "Pass for mailfrom",
+			check: &spfCheck{
+				result:   spf.Pass,
+				identity: "mailfrom",
+				sender:   "sender@example.org",
+				ip:       net.ParseIP("192.0.2.1"),
+				helo:     "client.example.org",
+			},
+			want: `Received-SPF: pass (mx.example.com: domain of sender@example.org designates 192.0.2.1 as permitted sender) ` +
+				`receiver=mx.example.com; client-ip=192.0.2.1; envelope-from="sender@example.org"; helo=client.example.org; identity=mailfrom;`,
+		},
+		{
+			name: "Fail for helo",
+			check: &spfCheck{
+				result:   spf.Fail,
+				identity: "helo",
+				sender:   "postmaster@client.example.org",
+				ip:       net.ParseIP("2001:db8::1"),
+				helo:     "client.example.org",
+			},
+			want: `Received-SPF: fail (mx.example.com: domain of postmaster@client.example.org does not designate 2001:db8::1 as permitted sender) ` +
+				`receiver=mx.example.com; client-ip=2001:db8::1; envelope-from="postmaster@client.example.org"; helo=client.example.org; identity=helo;`,
+		},
+		{
+			name: "None without client IP",
+			check: &spfCheck{
+				result:   spf.None,
+				identity: "mailfrom",
+				sender:   "sender@example.org",
+				helo:     "client.example.org",
+			},
+			want: `Received-SPF: none (mx.example.com: domain of sender@example.org does not provide an SPF record) ` +
+				`receiver=mx.example.com; envelope-from="sender@example.org"; helo=client.example.org; identity=mailfrom;`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.check.header("mx.example.com"))
+		})
+	}
+}
+
+func TestCheckSPFNullSender(t *testing.T) {
+	check := checkSPF(context.Background(), &FakeResolver{}, nil, "client.example.org", "")
+
+	require.Equal(t, "helo", check.identity)
+	require.Equal(t, "postmaster@client.example.org", check.sender)
+	require.Equal(t, "client.example.org", check.domain)
+	require.Equal(t, spf.None, check.result)
+	require.Error(t, check.err)
+}
+
+func TestCheckSPFHeloLiteral(t *testing.T) {
+	records := &FakeResolver{Errors: map[string]error{"[192.0.2.1]": errors.New("unexpected lookup")}}
+
+	for _, helo := range []string{"[192.0.2.1]", "192.0.2.1", "localhost"} {
+		check := checkSPF(context.Background(), records, net.ParseIP("192.0.2.1"), helo, "")
+
+		require.Equal(t, spf.None, check.result, helo)
+		require.NoError(t, check.err, helo)
+	}
+}
+
+func TestSPFPolicy(t *testing.T) {
+	results := make(chan SPFResult, 1)
+
+	addr := startTestServer(t, &ServerConfig{
+		Resolver: &FakeResolver{TXT: map[string][]string{
+			"example.org": {"v=spf1 ip4:127.0.0.1 -all"},
+			"example.net": {"v=spf1 -all"},
+		}},
+		MailPolicies: []MailPolicy{SPFPolicy},
+		Handler: func(c *Context) error {
+			result, _, _ := c.SPF()
+			results <- result
+			return nil
+		},
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO [127.0.0.1]")
+	require.Equal(t, 250, code)
+
+	code, _ = command(t, c, "MAIL FROM:<sender@example.net>")
+	require.Equal(t, 550, code)
+
+	finishTransaction(t, c)
+	require.Equal(t, spf.Pass, <-results)
+}
@@ -0,0 +1,91 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultSpoolThreshold is the message size above which the body is spooled to a temp file.
+const DefaultSpoolThreshold = 1024 * 1024
+
+// spool holds the message body in memory until it grows over the threshold, then moves it to a temp file.
+type spool struct {
+	dir       string
+	threshold int64
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+func newSpool(dir string, threshold int64) *spool {
+	if threshold < 1 {
+		threshold = DefaultSpoolThreshold
+	}
+
+	return &spool{
+		dir:       dir,
+		threshold: threshold,
+	}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.threshold {
+		f, err := ioutil.TempFile(s.dir, "smtpsrv-*.eml")
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+
+		s.file = f
+		s.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+
+	s.size += int64(n)
+
+	return n, err
+}
+
+// Reader returns a new reader positioned at the start of the body.
+func (s *spool) Reader() io.ReadSeeker {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+func (s *spool) Size() int64 {
+	return s.size
+}
+
+// Close releases the spooled body, removing the temp file if any.
+func (s *spool) Close() error {
+	s.buf = bytes.Buffer{}
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	if rmErr := os.Remove(s.file.Name()); err == nil {
+		err = rmErr
+	}
+	s.file = nil
+
+	return err
+}
@@ -0,0 +1,78 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+		onDisk    bool
+	}{
+		{name: "Below threshold", threshold: 1024, onDisk: false},
+		{name: "Above threshold", threshold: 8, onDisk: true},
+	}
+
+	message := "Subject: spool\r\n\r\nhello world"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSpool(t.TempDir(), tt.threshold)
+			for _, chunk := range []string{message[:4], message[4:]} {
+				_, err := s.Write([]byte(chunk))
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tt.onDisk, s.file != nil)
+			require.Equal(t, int64(len(message)), s.Size())
+
+			for i := 0; i < 2; i++ {
+				data, err := ioutil.ReadAll(s.Reader())
+				require.NoError(t, err)
+				require.Equal(t, message, string(data))
+			}
+
+			var name string
+			if s.file != nil {
+				name = s.file.Name()
+			}
+
+			require.NoError(t, s.Close())
+
+			if name != "" {
+				_, err := os.Stat(name)
+				require.True(t, os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestContextReadAndParse(t *testing.T) {
+	s := NewSession(nil, func(c *Context) error {
+		raw, err := ioutil.ReadAll(c)
+		require.NoError(t, err)
+		require.Contains(t, string(raw), "Subject: spooled")
+
+		email, err := c.Parse()
+		require.NoError(t, err)
+		require.Equal(t, "spooled", email.Subject)
+
+		again, err := c.Parse()
+		require.NoError(t, err)
+		require.True(t, email == again)
+
+		return nil
+	})
+
+	err := s.Data(strings.NewReader("Subject: spooled\r\n\r\nbody"))
+	require.NoError(t, err)
+
+	s.Reset()
+	require.Nil(t, s.tx)
+}
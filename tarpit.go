@@ -0,0 +1,125 @@
+package smtpsrv
+
+import (
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultTarpitMaxDelay caps the tarpit delay when Tarpit.MaxDelay is zero, well below the
+// 5 minutes clients wait for a RCPT reply.
+const DefaultTarpitMaxDelay = 30 * time.Second
+
+// ErrTooManyInvalidRecipients is replied before disconnecting a client past Tarpit.MaxInvalidRecipients.
+var ErrTooManyInvalidRecipients = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many invalid recipients, closing connection",
+}
+
+// Tarpit slows down the RCPT replies to suspicious clients, as directory harvesters, instead of answering
+// them instantly. The delay grows with the rejected recipients of the connection and with its score.
+type Tarpit struct {
+	// Delay is added for each invalid recipient, one rejected with a 5xx and a 5.1.x or no enhanced code.
+	Delay time.Duration
+	// ScoreDelay is added for each point of score.
+	ScoreDelay time.Duration
+	// MaxDelay caps the delay, it defaults to DefaultTarpitMaxDelay.
+	MaxDelay time.Duration
+	// MaxInvalidRecipients disconnects the client once so many invalid recipients were rejected, zero disables it.
+	MaxInvalidRecipients int
+	// Score returns the score of the client, it defaults to the DNSBL score.
+	Score func(c *Context) float64
+}
+
+// delay returns how long to wait before replying to a RCPT.
+func (t *Tarpit) delay(c *Context) time.Duration {
+	score := t.score(c)
+	if score < 0 {
+		score = 0
+	}
+
+	d := time.Duration(c.session.rejectedRcpts)*t.Delay + time.Duration(score*float64(t.ScoreDelay))
+
+	max := t.MaxDelay
+	if max == 0 {
+		max = DefaultTarpitMaxDelay
+	}
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+func (t *Tarpit) score(c *Context) float64 {
+	if t.Score != nil {
+		return t.Score(c)
+	}
+
+	if result := c.DNSBL(); result != nil {
+		return result.Score
+	}
+
+	return 0
+}
+
+// tarpit delays the reply to a RCPT, err being its result, and disconnects harvesters.
+func (s *Session) tarpit(err error) error {
+	if invalidRecipient(err) {
+		s.rejectedRcpts++
+	}
+
+	t := s.config.Tarpit
+	if t == nil {
+		return err
+	}
+
+	c := &Context{session: s}
+	if d := t.delay(c); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		// the connection closed meanwhile, e.g. with the server, there is no one to reply to
+		select {
+		case <-timer.C:
+		case <-s.done:
+			return err
+		}
+	}
+
+	if invalidRecipient(err) && t.MaxInvalidRecipients > 0 && s.rejectedRcpts >= t.MaxInvalidRecipients {
+		s.logger().Printf("disconnecting %v after %d invalid recipients", s.remoteAddr(), s.rejectedRcpts)
+
+		if s.conn != nil {
+			if cn := connOf(s.conn.Conn()); cn != nil {
+				cn.closeAfterWrite = true
+			}
+		}
+
+		return ErrTooManyInvalidRecipients
+	}
+
+	return err
+}
+
+// invalidRecipient reports whether err rejects the recipient address for good: a 5xx reply whose enhanced
+// code is 5.1.x or isn't set. Temporary failures, e.g. greylisting, and policy rejections don't count.
+func invalidRecipient(err error) bool {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code/100 != 5 {
+		return false
+	}
+
+	switch smtpErr.EnhancedCode {
+	case smtp.EnhancedCodeNotSet, smtp.NoEnhancedCode:
+		return true
+	}
+
+	return smtpErr.EnhancedCode[1] == 1
+}
+
+// RejectedRecipients returns the number of invalid recipients rejected on the connection.
+func (c Context) RejectedRecipients() int {
+	return c.session.rejectedRcpts
+}
@@ -0,0 +1,199 @@
+package smtpsrv
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		tarpit   Tarpit
+		rejected int
+		score    float64
+		want     time.Duration
+	}{
+		{name: "clean", tarpit: Tarpit{Delay: time.Second, ScoreDelay: time.Second}},
+		{name: "rejected", tarpit: Tarpit{Delay: time.Second}, rejected: 3, want: 3 * time.Second},
+		{name: "score", tarpit: Tarpit{ScoreDelay: 2 * time.Second}, score: 1.5, want: 3 * time.Second},
+		{name: "both", tarpit: Tarpit{Delay: time.Second, ScoreDelay: time.Second}, rejected: 2, score: 2, want: 4 * time.Second},
+		{name: "negative score", tarpit: Tarpit{ScoreDelay: time.Second}, score: -5},
+		{name: "capped", tarpit: Tarpit{Delay: time.Second, MaxDelay: 5 * time.Second}, rejected: 10, want: 5 * time.Second},
+		{name: "default cap", tarpit: Tarpit{Delay: time.Minute}, rejected: 1, want: DefaultTarpitMaxDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSession(nil, nil)
+			s.rejectedRcpts = tt.rejected
+
+			score := tt.score
+			tt.tarpit.Score = func(c *Context) float64 { return score }
+
+			require.Equal(t, tt.want, tt.tarpit.delay(&Context{session: s}))
+		})
+	}
+}
+
+func TestTarpitDefaultScore(t *testing.T) {
+	s := NewSession(nil, nil)
+	tarpit := &Tarpit{ScoreDelay: time.Second}
+	require.Equal(t, time.Duration(0), tarpit.delay(&Context{session: s}))
+
+	s.dnsbl = &DNSBLResult{Score: 2}
+	require.Equal(t, 2*time.Second, tarpit.delay(&Context{session: s}))
+}
+
+// rejectUnknown is a RcptPolicy rejecting the recipients whose local part starts with "unknown".
+func rejectUnknown(c *Context, to *mail.Address) error {
+	if strings.HasPrefix(to.Address, "unknown") {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+
+	return nil
+}
+
+func TestTarpit(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		RcptPolicies: []RcptPolicy{rejectUnknown},
+		Tarpit:       &Tarpit{Delay: 300 * time.Millisecond, MaxInvalidRecipients: 3},
+		Logger:       &testLogger{},
+		Handler:      func(c *Context) error { return nil },
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+
+	// a valid recipient from a clean client is answered at once
+	start := time.Now()
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	require.Less(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	start = time.Now()
+	code, _ = command(t, c, "RCPT TO:<unknown1@example.com>")
+	require.Equal(t, 550, code)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	// a new EHLO keeps the client in the tarpit
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+
+	start = time.Now()
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	code, _ = command(t, c, "RCPT TO:<unknown2@example.com>")
+	require.Equal(t, 550, code)
+
+	start = time.Now()
+	code, msg := command(t, c, "RCPT TO:<unknown3@example.com>")
+	require.Equal(t, 421, code)
+	require.Equal(t, "4.7.0 Too many invalid recipients, closing connection", msg)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(900*time.Millisecond))
+
+	_, err := c.ReadLine()
+	require.Error(t, err)
+}
+
+func TestTarpitScore(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		Tarpit: &Tarpit{
+			ScoreDelay: time.Second,
+			MaxDelay:   150 * time.Millisecond,
+			Score:      func(c *Context) float64 { return 5 },
+		},
+		Handler: func(c *Context) error { return nil },
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+
+	start := time.Now()
+	code, _ = command(t, c, "RCPT TO:<recipient@example.com>")
+	require.Equal(t, 250, code)
+
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, int64(elapsed), int64(150*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(time.Second))
+}
+
+func TestTarpitInterrupted(t *testing.T) {
+	done := make(chan struct{})
+
+	s := NewSession(nil, nil)
+	s.config = &ServerConfig{Tarpit: &Tarpit{Delay: time.Minute}}
+	s.rejectedRcpts = 1
+	s.done = done
+
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+
+	start := time.Now()
+	require.NoError(t, s.tarpit(nil))
+	require.Less(t, int64(time.Since(start)), int64(10*time.Second))
+}
+
+func TestConnDone(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	cn := &conn{Conn: server, done: make(chan struct{})}
+	require.NoError(t, cn.Close())
+	cn.Close()
+
+	select {
+	case <-cn.done:
+	default:
+		t.Fatal("done isn't closed")
+	}
+}
+
+func TestTarpitGreylist(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		RcptPolicies: []RcptPolicy{(&Greylist{}).Policy},
+		Tarpit:       &Tarpit{Delay: time.Minute, MaxInvalidRecipients: 1},
+		Handler:      func(c *Context) error { return nil },
+	})
+
+	c, code, _ := dialTestServer(t, addr)
+	require.Equal(t, 220, code)
+	code, _ = command(t, c, "EHLO client.example.org")
+	require.Equal(t, 250, code)
+	code, _ = command(t, c, "MAIL FROM:<sender@example.org>")
+	require.Equal(t, 250, code)
+
+	// temporary failures aren't invalid recipients, the client is neither delayed nor disconnected
+	for _, rcpt := range []string{"first@example.com", "second@example.com"} {
+		code, _ = command(t, c, "RCPT TO:<%s>", rcpt)
+		require.Equal(t, 451, code)
+	}
+
+	code, _ = command(t, c, "NOOP")
+	require.Equal(t, 250, code)
+}
+
+func TestInvalidRecipient(t *testing.T) {
+	require.True(t, invalidRecipient(&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}}))
+	require.True(t, invalidRecipient(&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCodeNotSet}))
+	require.False(t, invalidRecipient(nil))
+	require.False(t, invalidRecipient(ErrGreylisted))
+	require.False(t, invalidRecipient(&smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}}))
+	require.False(t, invalidRecipient(&smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 1, 1}}))
+}
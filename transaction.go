@@ -0,0 +1,129 @@
+package smtpsrv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// transaction holds the state of a single MAIL FROM .. DATA exchange, it is dropped on Reset.
+type transaction struct {
+	id      string
+	started bool
+	// size is the SIZE parameter of MAIL FROM, zero when not given.
+	size int64
+	// prepend holds the header fields to add once the message is received, e.g. asked by a policy service.
+	prepend []string
+
+	body      *spool
+	reader    io.Reader
+	email     *Email
+	emailErr  error
+	header    *Email
+	headerErr error
+
+	spf     *spfCheck
+	dkim    []DKIMResult
+	dkimErr error
+	dmarc   *DMARCResult
+	arc     *ARCResult
+	dnsbl   *DNSBLResult
+	virus   *VirusScanResult
+	rspamd  *RspamdResult
+	score   *ScoreResult
+	// discard drops the message once accepted, as asked by a milter.
+	discard bool
+	// mailable caches the Mailable checks by domain.
+	mailable map[string]*MailableResult
+}
+
+// newQueueID returns a random postfix like queue id, e.g. 4F1A9C03B2D7.
+func newQueueID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// transaction returns the current transaction, creating a new one if needed.
+func (s *Session) transaction() *transaction {
+	if s.tx == nil {
+		s.tx = &transaction{id: newQueueID()}
+	}
+
+	return s.tx
+}
+
+// startTransaction marks the current transaction as accepted and calls OnTransactionStart.
+func (s *Session) startTransaction() {
+	tx := s.transaction()
+	if tx.started {
+		return
+	}
+
+	tx.started = true
+
+	if s.config.OnTransactionStart != nil {
+		s.config.OnTransactionStart(&Context{session: s})
+	}
+}
+
+// endTransaction calls OnTransactionEnd for a started transaction and drops its state.
+func (s *Session) endTransaction() {
+	if s.tx == nil {
+		return
+	}
+
+	if s.tx.started && s.config.OnTransactionEnd != nil {
+		s.config.OnTransactionEnd(&Context{session: s})
+	}
+
+	if s.tx.body != nil {
+		if err := s.tx.body.Close(); err != nil {
+			s.logger().Printf("releasing spooled body of %s: %v", s.tx.id, err)
+		}
+	}
+
+	s.tx = nil
+}
+
+// replaceBody swaps the message for body, e.g. once rewritten, and drops what was parsed from it.
+func (tx *transaction) replaceBody(body *spool) {
+	tx.body.Close()
+	tx.body = body
+	tx.reader, tx.email, tx.emailErr, tx.header, tx.headerErr = nil, nil, nil, nil, nil
+}
+
+// prependFields adds the raw header fields on top of the message.
+func (s *Session) prependFields(fields []string) error {
+	header, body, err := readRawHeader(s.transaction().body.Reader())
+	if err != nil {
+		return err
+	}
+
+	return s.rewriteMessage(append(fields, header...), body)
+}
+
+// rewriteMessage spools the raw header fields and the body as the new message.
+func (s *Session) rewriteMessage(fields []string, body io.Reader) error {
+	spooled := newSpool(s.config.SpoolDir, s.config.SpoolThreshold)
+
+	for _, field := range append(fields, "\r\n") {
+		if _, err := io.WriteString(spooled, field); err != nil {
+			spooled.Close()
+			return err
+		}
+	}
+
+	if _, err := io.Copy(spooled, body); err != nil {
+		spooled.Close()
+		return err
+	}
+
+	s.transaction().replaceBody(spooled)
+
+	return nil
+}